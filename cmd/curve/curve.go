@@ -1,93 +1,425 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/scheibo/calc"
+	"github.com/scheibo/perf"
+	. "github.com/scheibo/stravutils"
 )
 
 const MR = 67.0
 
-var DURATIONS = [...]int{5, 10, 30, 60, 180, 300, 600, 1200, 1800, 3600}
+var DURATIONS = [...]int{5, 10, 30, 60, 180, 300, 600, 1200, 1800, 3600, 7200, 10800, 14400, 21600}
 
 func CaM(t float64) float64 {
 	return 1372.73/(1+t/20.44) + 427.21/(1+t/24994.53)
 }
 
 func CpM(t float64) float64 {
-	return 422.58 + 23296.7801287949/t
+	return perf.CpM(t)
+}
+
+// CaF is CaM scaled by the ratio of the female to male world record curves.
+func CaF(t float64) float64 {
+	return CaM(t) * perf.CpF(t) / perf.CpM(t)
+}
+
+func CpF(t float64) float64 {
+	return perf.CpF(t)
+}
+
+// Reference is a power-duration curve of a reference rider with a given mass
+// which is scaled to match the athlete's performance.
+type Reference struct {
+	Mass  float64
+	Power func(t float64) float64
+}
+
+type PointsFlag struct {
+	Points []PowerDurationPoint
+}
+
+func (p *PointsFlag) String() string {
+	return fmt.Sprintf("%v", p.Points)
+}
+
+// Set parses a 'power:duration' pair, eg. '300:20m'.
+func (p *PointsFlag) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		pt, err := parsePoint(strings.Split(s, ":"))
+		if err != nil {
+			return err
+		}
+		p.Points = append(p.Points, pt)
+	}
+	return nil
 }
 
 func main() {
-	var cp bool
-	var mr, p1, t1, p2, t2 float64
+	var cp, efforts bool
+	var mr, p1, t1, p2, t2, rmass float64
 	var dur1, dur2 time.Duration
+	var x, pointsFile, refFile, format, token, climbsFile string
+	var pf PointsFlag
 
 	flag.BoolVar(&cp, "cp", false, "whether to use the CP model")
 	flag.Float64Var(&mr, "mr", 67.0, "the mass of the rider in kg")
+	flag.StringVar(&x, "x", "M", "sex of the reference rider")
+	flag.StringVar(&refFile, "reference", "", "CSV of 'duration,power' for a custom reference curve")
+	flag.Float64Var(&rmass, "rmass", MR, "the mass of the rider for the custom reference curve in kg")
 
 	flag.Float64Var(&p1, "p1", 0, "power maintained for t1")
 	flag.Float64Var(&p2, "p2", 0, "power maintained for t2")
 	flag.DurationVar(&dur1, "t1", 0, "duration in minutes and seconds ('12m34s')")
 	flag.DurationVar(&dur2, "t2", 0, "duration in minutes and seconds ('12m34s')")
 
+	flag.Var(&pf, "point", "'power:duration' pair to fit models to ('300:20m'), may be repeated")
+	flag.StringVar(&pointsFile, "points", "", "CSV of 'power,duration' pairs to fit models to")
+	flag.BoolVar(&efforts, "efforts", false, "fit models to segment efforts with power meter data")
+	flag.StringVar(&token, "token", "", "Access Token")
+	flag.StringVar(&climbsFile, "climbs", "", "Climbs")
+	flag.StringVar(&format, "format", "text", "Output format (text, csv or json)")
+
 	flag.Parse()
 
-	if p1 <= 0 || dur1 <= 0 {
-		exit(fmt.Errorf("p1 and t1 must both specified and be > 0"))
+	points := pf.Points
+	if pointsFile != "" {
+		ps, err := readPoints(pointsFile)
+		if err != nil {
+			exit(err)
+		}
+		points = append(points, ps...)
+	}
+
+	if efforts {
+		climbs, err := GetClimbs(climbsFile)
+		if err != nil {
+			exit(err)
+		}
+		ps, err := GetPowerPoints(climbs, -1, token)
+		if err != nil {
+			exit(err)
+		}
+		points = append(points, Envelope(ps)...)
 	}
 
-	verify("t1", float64(dur1))
-	t1 = float64(dur1 / time.Second)
+	if (p1 > 0) != (dur1 > 0) {
+		exit(fmt.Errorf("p1 and t1 must both be specified and be > 0"))
+	}
+	if p1 > 0 {
+		verify("t1", float64(dur1))
+		t1 = float64(dur1 / time.Second)
+	}
+
+	if len(points) > 0 {
+		if p2 > 0 || dur2 > 0 {
+			exit(fmt.Errorf("p2 and t2 can't be specified when fitting models"))
+		}
+		if p1 > 0 {
+			points = append(points, PowerDurationPoint{Power: p1, Duration: t1})
+		}
+		models, err := FitCurves(points)
+		if err != nil {
+			exit(err)
+		}
+		err = outputModels(models, mr, format)
+		if err != nil {
+			exit(err)
+		}
+		return
+	}
+
+	if p1 <= 0 {
+		exit(fmt.Errorf("p1 and t1 must both be specified and be > 0"))
+	}
 
 	if p2 > 0 && dur2 > 0 {
 		exit(fmt.Errorf("p2 and t2 can't both be specified"))
 	}
 
-	scale := (p1 / mr) / (power(t1, cp) / MR)
+	ref, err := reference(x, cp, refFile, rmass)
+	if err != nil {
+		exit(err)
+	}
+
+	var scaled []PowerDurationPoint
+	scale := (p1 / mr) / (ref.Power(t1) / ref.Mass)
 	if p2 <= 0 && dur2 <= 0 {
 		for _, t := range DURATIONS {
-			p := power(float64(t), cp) * scale
-			output(p, float64(t), mr)
+			p := ref.Power(float64(t)) / ref.Mass * mr * scale
+			scaled = append(scaled, PowerDurationPoint{Power: p, Duration: float64(t)})
 		}
 	} else if p2 > 0 {
-		t2 = duration(p2, scale, cp)
-
-		output(p2, t2, mr)
+		t2 = duration(p2/mr*ref.Mass, scale, ref)
+		scaled = append(scaled, PowerDurationPoint{Power: p2, Duration: t2})
 	} else {
 		verify("t2", float64(dur2))
 		t2 = float64(dur2 / time.Second)
 
-		p2 = ((power(t2, cp) / MR) * scale) * mr
-		output(p2, t2, mr)
+		p2 = ((ref.Power(t2) / ref.Mass) * scale) * mr
+		scaled = append(scaled, PowerDurationPoint{Power: p2, Duration: t2})
+	}
+
+	err = output(scaled, mr, format)
+	if err != nil {
+		exit(err)
 	}
 }
 
-func output(p, t, mr float64) {
-	fmt.Printf("%s: %.2f W (%.2f W/kg)\n", time.Duration(t)*time.Second, p, p/mr)
+func output(points []PowerDurationPoint, mr float64, format string) error {
+	switch format {
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		err := w.Write([]string{"duration", "power", "wkg"})
+		if err != nil {
+			return err
+		}
+		for _, pt := range points {
+			err = w.Write([]string{
+				fmt.Sprintf("%.0f", pt.Duration),
+				fmt.Sprintf("%.2f", pt.Power),
+				fmt.Sprintf("%.2f", pt.Power/mr)})
+			if err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+	case "json":
+		type point struct {
+			Duration float64 `json:"duration"`
+			Power    float64 `json:"power"`
+			WKG      float64 `json:"wkg"`
+		}
+		var curve []point
+		for _, pt := range points {
+			curve = append(curve, point{pt.Duration, pt.Power, pt.Power / mr})
+		}
+		j, err := json.MarshalIndent(curve, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(j))
+		return nil
+	case "text":
+		for _, pt := range points {
+			fmt.Printf("%s: %.2f W (%.2f W/kg)\n", time.Duration(pt.Duration)*time.Second, pt.Power, pt.Power/mr)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+}
+
+func outputModels(models []*CurveModel, mr float64, format string) error {
+	switch format {
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		err := w.Write([]string{"model", "duration", "power", "wkg"})
+		if err != nil {
+			return err
+		}
+		for _, m := range models {
+			for _, t := range DURATIONS {
+				p := m.Power(float64(t))
+				err = w.Write([]string{
+					m.Model,
+					strconv.Itoa(t),
+					fmt.Sprintf("%.2f", p),
+					fmt.Sprintf("%.2f", p/mr)})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		w.Flush()
+		return w.Error()
+	case "json":
+		type point struct {
+			Duration int                `json:"duration"`
+			Power    map[string]float64 `json:"power"`
+		}
+		var curve []point
+		for _, t := range DURATIONS {
+			pt := point{Duration: t, Power: make(map[string]float64)}
+			for _, m := range models {
+				pt.Power[m.Model] = m.Power(float64(t))
+			}
+			curve = append(curve, pt)
+		}
+		j, err := json.MarshalIndent(struct {
+			Models []*CurveModel `json:"models"`
+			Curve  []point       `json:"curve"`
+		}{models, curve}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(j))
+		return nil
+	case "text":
+		for _, m := range models {
+			fmt.Println(m)
+		}
+		fmt.Println()
+		for _, t := range DURATIONS {
+			var ps []string
+			for _, m := range models {
+				p := m.Power(float64(t))
+				ps = append(ps, fmt.Sprintf("%s %.2f W (%.2f W/kg)", m.Model, p, p/mr))
+			}
+			fmt.Printf("%s: %s\n", time.Duration(t)*time.Second, strings.Join(ps, " / "))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
 }
 
-func power(t float64, cp bool) float64 {
+func reference(x string, cp bool, file string, mass float64) (*Reference, error) {
+	if file != "" {
+		return readReference(file, mass)
+	}
+
+	if x == "F" {
+		if cp {
+			return &Reference{MR_F, CpF}, nil
+		}
+		return &Reference{MR_F, CaF}, nil
+	}
+
 	if cp {
-		return CpM(t)
-	} else {
-		return CaM(t)
+		return &Reference{MR, CpM}, nil
+	}
+	return &Reference{MR, CaM}, nil
+}
+
+// readReference reads a custom reference curve, interpolating between its
+// points in log-log space.
+func readReference(file string, mass float64) (*Reference, error) {
+	rows, err := readCSV(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []PowerDurationPoint
+	for _, row := range rows {
+		if len(row) != 2 {
+			return nil, fmt.Errorf("expected 'duration,power' but got %v", row)
+		}
+		pt, err := parsePoint([]string{row[1], row[0]})
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	if len(points) < 2 {
+		return nil, fmt.Errorf("reference curve must have at least 2 points")
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Duration < points[j].Duration })
+
+	return &Reference{mass, func(t float64) float64 {
+		i := sort.Search(len(points), func(i int) bool { return points[i].Duration >= t })
+		if i == 0 {
+			i = 1
+		} else if i == len(points) {
+			i = len(points) - 1
+		}
+		a, b := points[i-1], points[i]
+		f := math.Log(t/a.Duration) / math.Log(b.Duration/a.Duration)
+		return math.Exp(math.Log(a.Power) + f*(math.Log(b.Power)-math.Log(a.Power)))
+	}}, nil
+}
+
+func readPoints(file string) ([]PowerDurationPoint, error) {
+	rows, err := readCSV(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []PowerDurationPoint
+	for _, row := range rows {
+		pt, err := parsePoint(row)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
+
+func readCSV(file string) ([][]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows [][]string
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parsePoint parses a 'power,duration' pair where duration is either in
+// seconds or a duration string such as '12m34s'.
+func parsePoint(s []string) (PowerDurationPoint, error) {
+	if len(s) != 2 {
+		return PowerDurationPoint{}, fmt.Errorf("expected 'power,duration' but got %v", s)
+	}
+
+	p, err := strconv.ParseFloat(strings.TrimSpace(s[0]), 64)
+	if err != nil {
+		return PowerDurationPoint{}, err
+	}
+
+	v := strings.TrimSpace(s[1])
+	t, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return PowerDurationPoint{}, err
+		}
+		t = float64(d / time.Second)
+	}
+
+	if p <= 0 || t <= 0 {
+		return PowerDurationPoint{}, fmt.Errorf("power and duration must be > 0 but got %v", s)
 	}
+	return PowerDurationPoint{Power: p, Duration: t}, nil
 }
 
-func duration(p, scale float64, cp bool) float64 {
+func duration(p, scale float64, ref *Reference) float64 {
 	// epsilon is some small value that determines when we will stop the search
 	const epsilon = 1e-6
 	// max is the maxmium number of iterations of the search
 	const max = 100
 
-	tl, tm, th := 0.0, 3600.0, 7200.0
+	tl, tm, th := 0.0, MAX_DURATION/2, MAX_DURATION
 	for j := 0; j < max; j++ {
 
-		p1 := power(tm, cp) * scale
+		p1 := ref.Power(tm) * scale
 		if calc.Eqf(p1, p, epsilon) {
 			break
 		}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	. "github.com/scheibo/stravutils"
+)
+
+func main() {
+	var summary bool
+	var token, climbsFile, bounds, polygonFile, local string
+	var tile float64
+	var opts DiscoverOptions
+	var empty, result []Climb
+
+	flag.StringVar(&token, "token", "", "Access Token")
+	flag.StringVar(&climbsFile, "climbs", "", "Climbs to exclude from the results")
+
+	flag.StringVar(&bounds, "bounds", "", "Region to search as 'sw_lat,sw_lng,ne_lat,ne_lng'")
+	flag.StringVar(&polygonFile, "polygon", "", "JSON file of the points of the region to search")
+	flag.Float64Var(&tile, "tile", 5, "length in km of the side of each tile to explore")
+	flag.IntVar(&opts.MaxDepth, "depth", 2, "number of times to split tiles with too many segments")
+	flag.StringVar(&local, "local", "", "JSON file of segments to explore instead of Strava")
+
+	flag.IntVar(&opts.MinCategory, "minCat", 1, "minimum climb category (0 = uncategorized, 5 = HC)")
+	flag.IntVar(&opts.MaxCategory, "maxCat", MAX_CATEGORY, "maximum climb category (0 = uncategorized, 5 = HC)")
+	flag.Float64Var(&opts.MinDistance, "distance", 1000, "minimum distance in m")
+	flag.Float64Var(&opts.MinGrade, "grade", 0.03, "minimum average grade")
+	flag.Float64Var(&opts.MinGain, "gain", 50, "minimum elevation gain in m")
+
+	flag.BoolVar(&summary, "summary", false, "Only use the summary data from exploring instead of fetching each segment")
+
+	flag.Parse()
+
+	if tile <= 0 {
+		exit(fmt.Errorf("tile must be positive but was %f", tile))
+	}
+	verify("depth", float64(opts.MaxDepth))
+	if opts.MinCategory < 0 || opts.MaxCategory > MAX_CATEGORY || opts.MinCategory > opts.MaxCategory {
+		exit(fmt.Errorf("climb categories must satisfy 0 <= minCat <= maxCat <= %d", MAX_CATEGORY))
+	}
+
+	var tiles []Bounds
+	if polygonFile != "" {
+		polygon, err := GetPolygon(polygonFile)
+		if err != nil {
+			exit(err)
+		}
+		tiles = TilePolygon(polygon, tile*1000)
+		opts.Polygon = polygon
+	} else if bounds != "" {
+		b, err := ParseBounds(bounds)
+		if err != nil {
+			exit(err)
+		}
+		tiles = b.Tile(tile * 1000)
+	} else {
+		exit(fmt.Errorf("bounds or polygon must be specified"))
+	}
+
+	var explorer Explorer
+	var err error
+	if local != "" {
+		explorer, err = GetLocalExplorer(local)
+	} else {
+		explorer, err = NewStravaExplorer(token)
+	}
+	if err != nil {
+		exit(err)
+	}
+
+	known := make(map[int64]bool)
+	if climbsFile != "" {
+		climbs, err := GetClimbs(climbsFile)
+		if err != nil {
+			exit(err)
+		}
+		for _, c := range climbs {
+			known[c.Segment.ID] = true
+		}
+	}
+
+	segments, err := Discover(explorer, tiles, opts)
+	if err != nil {
+		exit(err)
+	}
+
+	for i := range segments {
+		es := &segments[i]
+		if known[es.Id] {
+			continue
+		}
+
+		var s *Segment
+		if summary {
+			s, err = ExplorerSegmentToSegment(es)
+		} else {
+			s, err = GetSegmentByID(es.Id, empty, token)
+		}
+		if err != nil {
+			exit(err)
+		}
+
+		result = append(result, Climb{Name: s.Name, Segment: *s})
+	}
+
+	j, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		exit(err)
+	}
+	fmt.Println(string(j))
+}
+
+func verify(s string, x float64) {
+	if x < 0 {
+		exit(fmt.Errorf("%s must be non negative but was %f", s, x))
+	}
+}
+
+func exit(err error) {
+	fmt.Fprintf(os.Stderr, "%s\n\n", err)
+	flag.PrintDefaults()
+	os.Exit(1)
+}
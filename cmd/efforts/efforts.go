@@ -1,16 +1,18 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"sort"
+	"strconv"
 	"time"
 
-	"github.com/scheibo/calc"
-	"github.com/scheibo/perf"
 	"github.com/scheibo/strava"
 	. "github.com/scheibo/stravutils"
+	"github.com/scheibo/weather"
 )
 
 type Effort struct {
@@ -18,12 +20,35 @@ type Effort struct {
 	effort strava.DetailedSegmentEffort
 	score  float64
 	power  float64
+	// Only set if the efforts are being normalized for weather.
+	conditions      *weather.Conditions
+	wnf             float64
+	normalizedTime  float64
+	normalizedScore float64
+}
+
+// Record is the representation of an Effort used for CSV and JSON output.
+type Record struct {
+	Rank           int                 `json:"rank"`
+	Name           string              `json:"name"`
+	SegmentID      int64               `json:"segmentId"`
+	ActivityID     int64               `json:"activityId"`
+	EffortID       int64               `json:"effortId"`
+	Date           time.Time           `json:"date"`
+	Time           int                 `json:"time"`
+	Power          float64             `json:"power"`
+	PERF           float64             `json:"perf"`
+	NormalizedTime float64             `json:"normalizedTime,omitempty"`
+	NormalizedPERF float64             `json:"normalizedPerf,omitempty"`
+	WNF            float64             `json:"wnf,omitempty"`
+	Conditions     *weather.Conditions `json:"weather,omitempty"`
 }
 
 func main() {
-	var best bool
-	var token, climbsFile string
-	var cda, mt, mr, mb float64
+	var best, normalize, offline bool
+	var token, climbsFile, key, cache, tz, format string
+	var qps int
+	var cda, mr, mb float64
 
 	var climbs []Climb
 	var efforts []*Effort
@@ -31,60 +56,217 @@ func main() {
 	flag.BoolVar(&best, "best", false, "Best effort per climb only")
 	flag.StringVar(&token, "token", "", "Access Token")
 	flag.StringVar(&climbsFile, "climbs", "", "Climbs")
+	flag.StringVar(&format, "format", "text", "Output format (text, csv or json)")
 
 	flag.Float64Var(&cda, "cda", 0.325, "coefficient of drag area")
 	flag.Float64Var(&mr, "mr", 67.0, "total mass of the rider in kg")
 	flag.Float64Var(&mb, "mb", 8.0, "total mass of the bicycle in kg")
 
+	flag.BoolVar(&normalize, "normalize", false, "Rank efforts by their weather normalized PERF")
+	flag.StringVar(&key, "key", os.Getenv("DARKSKY_API_KEY"), "DarkySky API Key")
+	flag.StringVar(&cache, "cache", "", "cache directory for historical queries")
+	flag.IntVar(&qps, "qps", 100, "maximum queries per second against darksky")
+	flag.BoolVar(&offline, "offline", false, "whether or not to run in offline mode")
+	flag.StringVar(&tz, "tz", "America/Los_Angeles", "timezone to use")
+
 	flag.Parse()
 
 	verify("cda", cda)
 	verify("mr", mr)
 	verify("mb", mb)
-	mt = mr + mb
 
-	climbs, err := GetClimbs(climbsFile)
+	if format != "text" && format != "csv" && format != "json" {
+		exit(fmt.Errorf("unknown format: %s", format))
+	}
+
+	loc, err := time.LoadLocation(tz)
 	if err != nil {
 		exit(err)
 	}
 
+	climbs, err = GetClimbs(climbsFile)
+	if err != nil {
+		exit(err)
+	}
+
+	// The best raw effort is on the first page, but the best normalized effort
+	// could be any of them.
 	maxPages := -1
-	if best {
+	if best && !normalize {
 		maxPages = 1
 	}
 
+	rider := &Rider{Mass: mr, BikeMass: mb, CdA: cda}
+	w := NewWeatherClient(key, cache, qps, loc, offline)
+
 	for _, climb := range climbs {
 		es, err := GetEfforts(climb.Segment.ID, maxPages, token)
 		if err != nil {
 			exit(err)
 		}
 
+		var top *Effort
 		for _, e := range es {
-			gr := climb.Segment.AverageGrade
-			score := perf.CalcM(float64(e.ElapsedTime), climb.Segment.Distance, gr, climb.Segment.MedianElevation)
-			power := power(float64(e.ElapsedTime), climb.Segment.Distance, gr, climb.Segment.MedianElevation, mt, cda)
+			t := float64(e.ElapsedTime)
+			power := rider.StillAirPower(t, &climb.Segment)
+			score := rider.Score(power, t, &climb.Segment)
 
 			effort := &Effort{climb: climb, effort: e, score: score, power: power}
-			efforts = append(efforts, effort)
+			if normalize {
+				err := effort.normalize(w, rider)
+				if err != nil {
+					exit(err)
+				}
+			}
 
-			// Only care about the first effort if --best
-			if best {
-				break
+			if !best {
+				efforts = append(efforts, effort)
+			} else if top == nil || top.less(effort, normalize) {
+				top = effort
 			}
 		}
+		if top != nil {
+			efforts = append(efforts, top)
+		}
+	}
+
+	efforts = sortEfforts(efforts, normalize)
+	switch format {
+	case "csv":
+		err = outputCSV(efforts, normalize)
+	case "json":
+		err = outputJSON(efforts, normalize)
+	default:
+		outputText(efforts, normalize)
+	}
+	if err != nil {
+		exit(err)
+	}
+}
+
+// normalize attaches the historical weather conditions at the time of the
+// effort and computes the time and PERF the effort would have been worth in
+// still air.
+func (e *Effort) normalize(w *Weather, rider *Rider) error {
+	s := &e.climb.Segment
+	t := float64(e.effort.ElapsedTime)
+
+	c, err := w.HistoricalConditions(s.AverageLocation, e.effort.StartDate)
+	if err != nil {
+		return err
+	}
+	e.conditions = c
+
+	p, err := RequiredPower(t, s, c, rider)
+	if err != nil {
+		return err
+	}
+	e.wnf = p / rider.StillAirPower(t, s)
+
+	e.normalizedTime, err = PredictTime(func(float64) float64 { return p }, s, nil, rider)
+	if err != nil {
+		return err
+	}
+	// p is the power which completes the segment in normalizedTime in still air.
+	e.normalizedScore = rider.Score(p, e.normalizedTime, s)
+
+	return nil
+}
+
+func (e *Effort) record(rank int, normalize bool) Record {
+	r := Record{
+		Rank:       rank,
+		Name:       e.climb.Name,
+		SegmentID:  e.climb.Segment.ID,
+		ActivityID: e.effort.Activity.Id,
+		EffortID:   e.effort.Id,
+		Date:       e.effort.StartDateLocal,
+		Time:       int(e.effort.ElapsedTime),
+		Power:      e.power,
+		PERF:       e.score,
+	}
+	if normalize {
+		r.NormalizedTime = e.normalizedTime
+		r.NormalizedPERF = e.normalizedScore
+		r.WNF = e.wnf
+		r.Conditions = e.conditions
 	}
+	return r
+}
 
-	efforts = sortEfforts(efforts)
+func outputText(efforts []*Effort, normalize bool) {
 	for i, effort := range efforts {
 		fmt.Printf("%d) %s: %s = %.2f / %.2fW (%s)\n", i+1, effort.climb.Name,
 			(time.Duration(effort.effort.ElapsedTime) * time.Second),
 			effort.score, effort.power, effort.effort.StartDateLocal.Format("Mon Jan _2 3:04PM 2006"))
+		if normalize {
+			fmt.Printf("   => %s = %.2f (%.2f%%, %.1f°C, %.3f kg/m³, %s)\n",
+				(time.Duration(effort.normalizedTime) * time.Second).Round(time.Second),
+				effort.normalizedScore, (effort.wnf-1)*100,
+				effort.conditions.Temperature, effort.conditions.AirDensity, effort.conditions.Wind())
+		}
 	}
 }
 
-func power(t, d, gr, h, mt, cda float64) float64 {
-	vg := d / t
-	return calc.Psimp(calc.Rho(h, calc.G), cda, calc.Crr, vg, vg, gr, mt, calc.G, calc.Ec, calc.Fw)
+func outputCSV(efforts []*Effort, normalize bool) error {
+	w := csv.NewWriter(os.Stdout)
+
+	header := []string{"rank", "name", "segment_id", "activity_id", "effort_id", "date", "time", "power", "perf"}
+	if normalize {
+		header = append(header,
+			"normalized_time", "normalized_perf", "wnf",
+			"temperature", "air_density", "wind_speed", "wind_bearing")
+	}
+	err := w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for i, effort := range efforts {
+		r := effort.record(i+1, normalize)
+		row := []string{
+			strconv.Itoa(r.Rank),
+			r.Name,
+			strconv.FormatInt(r.SegmentID, 10),
+			strconv.FormatInt(r.ActivityID, 10),
+			strconv.FormatInt(r.EffortID, 10),
+			r.Date.Format(time.RFC3339),
+			strconv.Itoa(r.Time),
+			fmt.Sprintf("%.2f", r.Power),
+			fmt.Sprintf("%.2f", r.PERF),
+		}
+		if normalize {
+			row = append(row,
+				fmt.Sprintf("%.2f", r.NormalizedTime),
+				fmt.Sprintf("%.2f", r.NormalizedPERF),
+				fmt.Sprintf("%.4f", r.WNF),
+				fmt.Sprintf("%.1f", r.Conditions.Temperature),
+				fmt.Sprintf("%.4f", r.Conditions.AirDensity),
+				fmt.Sprintf("%.3f", r.Conditions.WindSpeed),
+				fmt.Sprintf("%.2f", r.Conditions.WindBearing))
+		}
+		err = w.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+func outputJSON(efforts []*Effort, normalize bool) error {
+	records := make([]Record, len(efforts))
+	for i, effort := range efforts {
+		records[i] = effort.record(i+1, normalize)
+	}
+
+	j, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(j))
+	return nil
 }
 
 func verify(s string, x float64) {
@@ -99,21 +281,32 @@ func exit(err error) {
 	os.Exit(1)
 }
 
-type Efforts []*Effort
+type Efforts struct {
+	efforts   []*Effort
+	normalize bool
+}
 
-func sortEfforts(e Efforts) Efforts {
-	sort.Sort(sort.Reverse(e))
+func sortEfforts(e []*Effort, normalize bool) []*Effort {
+	sort.Sort(sort.Reverse(Efforts{e, normalize}))
 	return e
 }
 
 func (e Efforts) Len() int {
-	return len(e)
+	return len(e.efforts)
 }
 
 func (e Efforts) Swap(i, j int) {
-	e[i], e[j] = e[j], e[i]
+	e.efforts[i], e.efforts[j] = e.efforts[j], e.efforts[i]
 }
 
 func (e Efforts) Less(i, j int) bool {
-	return e[i].score < e[j].score
+	return e.efforts[i].less(e.efforts[j], e.normalize)
+}
+
+// less returns whether e scores lower than o.
+func (e *Effort) less(o *Effort, normalize bool) bool {
+	if normalize {
+		return e.normalizedScore < o.normalizedScore
+	}
+	return e.score < o.score
 }
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"encoding/csv"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/scheibo/perf"
+	"github.com/araddon/dateparse"
+	. "github.com/scheibo/stravutils"
 )
 
 const FTP_DURATION = 60 * time.Minute
@@ -15,46 +21,302 @@ const ROAD_TO_TT = 0.87
 
 var MIX = [...]float64{3, 2.5, 1.5}
 
+// Z95 is the z-score for a 95% confidence interval.
+const Z95 = 1.96
+
+// Zone is a Coggan power training zone expressed as a fraction of FTP.
+type Zone struct {
+	Name string
+	Low  float64
+	High float64
+}
+
+var ZONES = [...]Zone{
+	{"Active Recovery", 0, 0.55},
+	{"Endurance", 0.55, 0.75},
+	{"Tempo", 0.75, 0.90},
+	{"Lactate Threshold", 0.90, 1.05},
+	{"VO2max", 1.05, 1.20},
+	{"Anaerobic Capacity", 1.20, 1.50},
+	{"Neuromuscular Power", 1.50, math.Inf(1)},
+}
+
+type MixFlag struct {
+	Mix *[3]float64
+}
+
+func (m *MixFlag) String() string {
+	if m.Mix == nil {
+		return ""
+	}
+	return fmt.Sprintf("%.1f,%.1f,%.1f", m.Mix[0], m.Mix[1], m.Mix[2])
+}
+
+func (m *MixFlag) Set(v string) error {
+	s := strings.Split(v, ",")
+	if len(s) != 3 {
+		return fmt.Errorf("expected 'climb,flat,tt' but got %s", v)
+	}
+	var mix [3]float64
+	for i := range s {
+		f, err := strconv.ParseFloat(strings.TrimSpace(s[i]), 64)
+		if err != nil {
+			return err
+		}
+		mix[i] = f
+	}
+	m.Mix = &mix
+	return nil
+}
+
 func main() {
-	var p, t, cp, ftp, ftpc, ftpf, ftptt float64
-	var x string
-	var dur time.Duration
+	var p, t, mr, ctf, rtt float64
+	var x, riderFile, effortsFile, token, climbsFile string
+	var strava bool
+	var dur, halfLife, since time.Duration
+	var mf MixFlag
 
 	flag.Float64Var(&p, "p", 0, "power maintained")
-	flag.StringVar(&x, "x", "M", "sex of the athlete")
+	flag.StringVar(&x, "x", "", "sex of the athlete (defaults to the rider profile's)")
+	flag.Float64Var(&mr, "mr", 0, "the mass of the athlete in kg (defaults to the rider profile's)")
 
 	flag.DurationVar(&dur, "t", 0, "duration in minutes and seconds ('12m34s')")
 
+	flag.StringVar(&riderFile, "rider", "", "Rider profile")
+	flag.StringVar(&effortsFile, "efforts", "", "CSV of 'power,duration[,date]' efforts")
+	flag.BoolVar(&strava, "strava", false, "include segment efforts with power meter data")
+	flag.StringVar(&token, "token", "", "Access Token")
+	flag.StringVar(&climbsFile, "climbs", "", "Climbs")
+	flag.DurationVar(&since, "since", 90*24*time.Hour, "ignore efforts older than this")
+	flag.DurationVar(&halfLife, "halflife", 42*24*time.Hour, "half-life of an effort's weight")
+
+	flag.Float64Var(&ctf, "climbToFlat", 0, fmt.Sprintf("ratio of flat to climbing FTP (default %.2f)", CLIMB_TO_FLAT))
+	flag.Float64Var(&rtt, "roadToTT", 0, fmt.Sprintf("ratio of TT to flat FTP (default %.2f)", ROAD_TO_TT))
+	flag.Var(&mf, "mix", "relative 'climb,flat,tt' weights for mixing FTPs (default 3,2.5,1.5)")
+
 	flag.Parse()
 
-	if p <= 0 {
-		exit(fmt.Errorf("p must be positive but was %f", p))
+	rider, err := GetRider(riderFile)
+	if err != nil {
+		exit(err)
+	}
+	config := ftpConfig(rider)
+	if x != "" {
+		rider.Sex = x
+	}
+	if mr > 0 {
+		rider.Mass = mr
+	}
+	if ctf > 0 {
+		config.ClimbToFlat = ctf
+	}
+	if rtt > 0 {
+		config.RoadToTT = rtt
+	}
+	if mf.Mix != nil {
+		config.Mix = *mf.Mix
 	}
 
-	if dur > 0 {
+	now := time.Now()
+	var efforts []PowerDurationPoint
+
+	if p > 0 || dur > 0 {
+		if p <= 0 {
+			exit(fmt.Errorf("p must be positive but was %f", p))
+		}
+		if dur <= 0 {
+			exit(fmt.Errorf("t must be specified and be > 0"))
+		}
 		verify("t", float64(dur))
 		t = float64(dur / time.Second)
-		if x == "M" {
-			cp = perf.CpM(t)
-			ftp = perf.CpM(float64(FTP_DURATION / time.Second))
+		efforts = append(efforts, PowerDurationPoint{Power: p, Duration: t, Date: now})
+	}
+
+	if effortsFile != "" {
+		es, err := readEfforts(effortsFile, now)
+		if err != nil {
+			exit(err)
+		}
+		efforts = append(efforts, es...)
+	}
 
-		} else {
-			cp = perf.CpF(t)
-			ftp = perf.CpF(float64(FTP_DURATION / time.Second))
+	if strava {
+		climbs, err := GetClimbs(climbsFile)
+		if err != nil {
+			exit(err)
 		}
+		es, err := GetPowerPoints(climbs, -1, token)
+		if err != nil {
+			exit(err)
+		}
+		// Only the best of the recent efforts count, otherwise repeated
+		// submaximal efforts on the same climbs drag the estimate down.
+		var recent []PowerDurationPoint
+		for _, e := range es {
+			if now.Sub(e.Date) <= since {
+				recent = append(recent, e)
+			}
+		}
+		efforts = append(efforts, Envelope(recent)...)
+	}
+
+	var recent []PowerDurationPoint
+	for _, e := range efforts {
+		age := now.Sub(e.Date)
+		if age > since {
+			continue
+		}
+		e.Weight = weight(e.Duration, age, halfLife)
+		recent = append(recent, e)
+	}
+
+	if len(recent) == 0 {
+		exit(fmt.Errorf("at least one recent effort must be specified"))
+	}
+
+	ftpc, ci := estimate(recent, rider)
+	ftpf := ftpc * config.ClimbToFlat
+	ftptt := ftpf * config.RoadToTT
 
+	mix := config.Mix
+	total := mix[0] + mix[1] + mix[2]
+	factor := (mix[0] + mix[1]*config.ClimbToFlat + mix[2]*config.ClimbToFlat*config.RoadToTT) / total
+	ftp := ftpc * factor
+
+	fmt.Printf("%.1f*(FTPc: %.2f) + %.1f*(FTPf: %.2f) + %.1f*(FTPtt: %.2f) => %.2f\n",
+		mix[0], ftpc, mix[1], ftpf, mix[2], ftptt, ftp)
+	if len(recent) > 1 {
+		fmt.Printf("95%% CI: %.2f - %.2f (%d efforts)\n", (ftpc-ci)*factor, (ftpc+ci)*factor, len(recent))
+	}
+
+	fmt.Println()
+	for i, z := range ZONES {
+		fmt.Printf("Z%d %s: %s\n", i+1, z.Name, zoneString(z, ftp, rider.Mass))
+	}
+}
+
+// ftpConfig returns the rider's FTPConfig with defaults for any of its
+// unspecified fields.
+func ftpConfig(rider *Rider) *FTPConfig {
+	config := FTPConfig{ClimbToFlat: CLIMB_TO_FLAT, RoadToTT: ROAD_TO_TT, Mix: MIX}
+	if rider.FTP == nil {
+		return &config
+	}
+	if rider.FTP.ClimbToFlat > 0 {
+		config.ClimbToFlat = rider.FTP.ClimbToFlat
+	}
+	if rider.FTP.RoadToTT > 0 {
+		config.RoadToTT = rider.FTP.RoadToTT
+	}
+	if rider.FTP.Mix != [3]float64{} {
+		config.Mix = rider.FTP.Mix
+	}
+	return &config
+}
+
+// weight returns how much an effort of duration t seconds which occurred age
+// ago should contribute to the FTP estimate. Efforts decay in relevance with
+// the given half-life and efforts far from FTP_DURATION are less predictive.
+func weight(t float64, age, halfLife time.Duration) float64 {
+	recency := math.Pow(0.5, float64(age)/float64(halfLife))
+	d := math.Log(t / float64(FTP_DURATION/time.Second))
+	return recency * math.Exp(-d*d/2)
+}
+
+// estimate returns the weighted mean climbing FTP for the efforts along with
+// the half-width of its 95% confidence interval.
+func estimate(efforts []PowerDurationPoint, rider *Rider) (float64, float64) {
+	ftp := rider.Cp(float64(FTP_DURATION / time.Second))
+
+	var sw, sww, mean float64
+	ftps := make([]float64, len(efforts))
+	for i, e := range efforts {
 		// Scale performance to FTP duration
-		ftpc = p / cp * ftp
-		ftpf = ftpc * CLIMB_TO_FLAT
-		ftptt = ftpf * ROAD_TO_TT
+		ftps[i] = e.Power / rider.Cp(e.Duration) * ftp
+		sw += e.Weight
+		sww += e.Weight * e.Weight
+		mean += e.Weight * ftps[i]
+	}
+	mean /= sw
+
+	if len(efforts) < 2 {
+		return mean, 0
+	}
 
-		ftp = ((MIX[0] * ftpc) + (MIX[1] * ftpf) + (MIX[2] * ftptt)) / 7
+	variance := 0.0
+	for i, e := range efforts {
+		d := ftps[i] - mean
+		variance += e.Weight * d * d
+	}
+	variance /= sw
+
+	// The effective sample size of the weighted efforts.
+	n := sw * sw / sww
+	if n <= 1 {
+		return mean, 0
+	}
+	return mean, Z95 * math.Sqrt(variance*n/(n-1)/n)
+}
+
+func zoneString(z Zone, ftp, mr float64) string {
+	lo, hi := z.Low*ftp, z.High*ftp
+	if math.IsInf(hi, 1) {
+		return fmt.Sprintf("> %.0f W (> %.2f W/kg)", lo, lo/mr)
+	}
+	return fmt.Sprintf("%.0f - %.0f W (%.2f - %.2f W/kg)", lo, hi, lo/mr, hi/mr)
+}
+
+func readEfforts(file string, now time.Time) ([]PowerDurationPoint, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var efforts []PowerDurationPoint
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) < 2 || len(row) > 3 {
+			return nil, fmt.Errorf("expected 'power,duration[,date]' but got %v", row)
+		}
+
+		p, err := strconv.ParseFloat(row[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		t, err := strconv.ParseFloat(row[1], 64)
+		if err != nil {
+			d, err := time.ParseDuration(row[1])
+			if err != nil {
+				return nil, err
+			}
+			t = float64(d / time.Second)
+		}
+		date := now
+		if len(row) == 3 {
+			date, err = dateparse.ParseLocal(row[2])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if p <= 0 || t <= 0 {
+			return nil, fmt.Errorf("power and duration must be > 0 but got %v", row)
+		}
 
-		fmt.Printf("%.1f*(FTPc: %.2f) + %.1f*(FTPf: %.2f) + %.1f*(FTPtt: %.2f) => %.2f\n",
-			MIX[0], ftpc, MIX[1], ftpf, MIX[2], ftptt, ftp)
-	} else {
-		exit(fmt.Errorf("t must be specified and be > 0"))
+		efforts = append(efforts, PowerDurationPoint{Power: p, Duration: t, Date: date})
 	}
+	return efforts, nil
 }
 
 func verify(s string, x float64) {
@@ -101,6 +101,9 @@ type GoalProgress struct {
 	// for the upcoming 'morning'.
 	// NOTE: This is *not* the same as the WNF for Forecast!
 	ForecastWNF float64 `json:"wnf"`
+	// The power required to achieve Goal.Time for each upcoming forecasted hour
+	// within the riding window as of Date.
+	Required []*Requirement `json:"required,omitempty"`
 }
 
 func (p *GoalProgress) Day() string {
@@ -135,6 +138,65 @@ func (p *GoalProgress) Title() string {
 	return fmt.Sprintf("%s (%.0f)\n%s", p.WWatts2(), math.Round(p.WPERF()), p.Weather())
 }
 
+// Lowest returns the upcoming hour with the lowest required power.
+func (p *GoalProgress) Lowest() *Requirement {
+	var lowest *Requirement
+	for _, r := range p.Required {
+		if lowest == nil || r.Watts < lowest.Watts {
+			lowest = r
+		}
+	}
+	return lowest
+}
+
+func (p *GoalProgress) NumAchievable() int {
+	num := 0
+	for _, r := range p.Required {
+		if r.Achievable {
+			num++
+		}
+	}
+	return num
+}
+
+type Requirement struct {
+	// Milliseconds since the epoch of the forecasted hour.
+	Date int `json:"date"`
+	// The power required to achieve the goal time under Conditions.
+	Watts float64 `json:"watts"`
+	// Watts relative to the mass of the rider.
+	WattsPerKg float64 `json:"wkg"`
+	// The PERF score of holding Watts for the goal time.
+	PERF float64 `json:"perf"`
+	// Whether the goal time is achievable given the PERF the rider is capable of.
+	Achievable bool `json:"achievable"`
+	// The forecasted weather conditions for the hour.
+	Conditions *weather.Conditions `json:"weather,omitempty"`
+}
+
+func (r *Requirement) DayTime() string {
+	return fromEpochMillis(r.Date).Format("Mon 3PM")
+}
+
+func (r *Requirement) Watts2() string {
+	return watts(r.Watts)
+}
+
+func (r *Requirement) WattsPerKg2() string {
+	return fmt.Sprintf("%.2f W/kg", r.WattsPerKg)
+}
+
+func (r *Requirement) Achieve() string {
+	if r.Achievable {
+		return "achievable"
+	}
+	return ""
+}
+
+func (r *Requirement) Title() string {
+	return fmt.Sprintf("%s (%.0f)\n%s", r.WattsPerKg2(), math.Round(r.PERF), weatherString(r.Conditions))
+}
+
 type Effort struct {
 	// ID of the activity the effort took place in.
 	ActivityID int64 `json:"activityId"`
@@ -225,6 +287,7 @@ type C struct {
 	climbs   *[]Climb
 	patches  map[int64]strava.DetailedSegmentEffort
 	newGoals map[int64]SegmentGoal
+	rider    *Rider
 	w        *weather.Client
 	refresh  time.Duration
 	now      time.Time
@@ -235,7 +298,7 @@ func main() {
 	now := time.Now()
 
 	var reload bool
-	var tz, key, token, output, goalsFile, patchesFile, climbsFile string
+	var tz, key, token, output, goalsFile, patchesFile, climbsFile, riderFile string
 	var refresh time.Duration
 
 	flag.BoolVar(&reload, "reload", false, "Perform a full reload instead of update.")
@@ -246,6 +309,7 @@ func main() {
 	flag.StringVar(&goalsFile, "goals", "", "Goals")
 	flag.StringVar(&patchesFile, "patch", "", "Patch to Strava segment efforts which are incorrect.")
 	flag.StringVar(&climbsFile, "climbs", "", "Climbs")
+	flag.StringVar(&riderFile, "rider", "", "Rider profile")
 
 	flag.DurationVar(&refresh, "refresh", 12*time.Hour,
 		"minimum refresh interval for GoalProgress.Forecast")
@@ -262,6 +326,11 @@ func main() {
 		exit(err)
 	}
 
+	rider, err := GetRider(riderFile)
+	if err != nil {
+		exit(err)
+	}
+
 	file := Resource("goals")
 	if goalsFile != "" {
 		file = goalsFile
@@ -337,6 +406,7 @@ func main() {
 		climbs:   &climbs,
 		patches:  patches,
 		newGoals: newGoals,
+		rider:    rider,
 		w:        weather.NewClient(weather.DarkSky(key), weather.TimeZone(loc)),
 		refresh:  refresh,
 		now:      now,
@@ -392,10 +462,53 @@ func (c *C) update(prev []GoalProgress) ([]GoalProgress, error) {
 		progress = append(progress, *u)
 	}
 
+	err := c.flagAchievable(progress)
+	if err != nil {
+		return nil, err
+	}
 	progress = sortProgress(progress)
 	return progress, nil
 }
 
+// flagAchievable marks which of the required powers for each goal are
+// achievable given the PERF the rider is capable of: that of the rider's
+// profile if set, otherwise the best effort or attempt for the goal itself.
+func (c *C) flagAchievable(progress []GoalProgress) error {
+	for i := range progress {
+		best := c.rider.PERF
+		if best <= 0 {
+			var err error
+			best, err = c.bestPERF(&progress[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, r := range progress[i].Required {
+			r.Achievable = best > 0 && r.PERF <= best
+		}
+	}
+	return nil
+}
+
+// bestPERF returns the highest PERF score of the rider's best effort and
+// attempt for the goal, scored under the same model as the required powers.
+func (c *C) bestPERF(p *GoalProgress) (float64, error) {
+	best := 0.0
+	for _, e := range []*Effort{p.BestEffort, p.BestAttempt} {
+		if e == nil {
+			continue
+		}
+		t := float64(e.Time)
+		pw, err := RequiredPower(t, p.Goal.segment, e.Conditions, c.rider)
+		if err != nil {
+			return 0, err
+		}
+		best = math.Max(best, c.rider.Score(pw, t, p.Goal.segment))
+	}
+	return best, nil
+}
+
 func (c *C) updateProgress(p *GoalProgress) (*GoalProgress, error) {
 	goal := p.Goal
 	efforts, err := GetEfforts(goal.SegmentID, 0, c.token)
@@ -450,13 +563,15 @@ func (c *C) updateProgress(p *GoalProgress) (*GoalProgress, error) {
 		}
 	}
 
-	forecast, forecastWNF := p.Forecast, p.ForecastWNF
+	forecast, forecastWNF, required := p.Forecast, p.ForecastWNF, p.Required
 	if c.reload || forecast == nil || c.now.Sub(fromEpochMillis(p.Date)) > c.refresh {
-		forecasts, err := c.getForecast(segment)
+		f, err := c.w.Forecast(segment.AverageLocation)
 		if err != nil {
 			return nil, err
 		}
 
+		forecasts := c.upcoming(f)
+
 		forecast = weather.Average(forecasts)
 		// NOTE: The forecastWNF is not computed simply as the WNF of the average
 		// forecast - instead we compute the WNF for each forecast and average the
@@ -470,6 +585,11 @@ func (c *C) updateProgress(p *GoalProgress) (*GoalProgress, error) {
 			forecastWNF += fWNF
 		}
 		forecastWNF /= float64(len(forecasts))
+
+		required, err = c.getRequired(goal, segment, ridingHours(f))
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	u := GoalProgress{
@@ -481,6 +601,7 @@ func (c *C) updateProgress(p *GoalProgress) (*GoalProgress, error) {
 		NumAttempts: numAttempts,
 		Forecast:    forecast,
 		ForecastWNF: forecastWNF,
+		Required:    required,
 	}
 
 	return &u, nil
@@ -574,12 +695,7 @@ func (c *C) toEffort(s *strava.DetailedSegmentEffort, segment *Segment) (*Effort
 	return &e, nil
 }
 
-func (c *C) getForecast(segment *Segment) ([]*weather.Conditions, error) {
-	f, err := c.w.Forecast(segment.AverageLocation)
-	if err != nil {
-		return nil, err
-	}
-
+func (c *C) upcoming(f *weather.Forecast) []*weather.Conditions {
 	// The upcoming forecast is for the current day unless we're already past
 	// the end hour, in which case we use the conditions for tomorrow.
 	t := c.now
@@ -600,7 +716,47 @@ func (c *C) getForecast(segment *Segment) ([]*weather.Conditions, error) {
 			cs = append(cs, h)
 		}
 	}
-	return cs, nil
+	return cs
+}
+
+// ridingHours returns all of the hours in the forecast which fall within the
+// riding window for their respective day.
+func ridingHours(f *weather.Forecast) []*weather.Conditions {
+	var cs []*weather.Conditions
+	for _, h := range f.Hourly {
+		begin, end := WEEKDAY_BEGIN_HOUR, WEEKDAY_END_HOUR
+		if weekend(h.Time) {
+			begin, end = WEEKEND_BEGIN_HOUR, WEEKEND_END_HOUR
+		}
+
+		if h.Time.Hour() >= begin && h.Time.Hour() <= end {
+			cs = append(cs, h)
+		}
+	}
+	return cs
+}
+
+func (c *C) getRequired(goal SegmentGoal, segment *Segment, forecasts []*weather.Conditions) ([]*Requirement, error) {
+	var required []*Requirement
+	for _, f := range forecasts {
+		if f.Time.Before(c.now) {
+			continue
+		}
+
+		p, err := RequiredPower(float64(goal.Time), segment, f, c.rider)
+		if err != nil {
+			return nil, err
+		}
+
+		required = append(required, &Requirement{
+			Date:       int(f.Time.Unix() * 1000),
+			Watts:      p,
+			WattsPerKg: p / c.rider.Mass,
+			PERF:       c.rider.Score(p, float64(goal.Time), segment),
+			Conditions: f,
+		})
+	}
+	return required, nil
 }
 
 func (c *C) render(goals []GoalProgress) error {
@@ -1,105 +1,189 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
-	"math"
 	"os"
 
-	"github.com/scheibo/geo"
 	. "github.com/scheibo/stravutils"
 )
 
+// Report is the result of cleaning a climb's elevation profile.
+type Report struct {
+	Name   string          `json:"name"`
+	ID     int64           `json:"id"`
+	Strava ElevationStats  `json:"strava"`
+	Before ElevationStats  `json:"before"`
+	After  *ElevationStats `json:"after,omitempty"`
+}
+
 func main() {
-	var token, climbsFile string
-	var outputJson bool
+	var climbsFile, filter string
+	var outputJson, clean, write, reconcile bool
+	var maxGrade, spikeWidth, window, spacing float64
 
-	flag.StringVar(&token, "token", "", "Access Token")
 	flag.StringVar(&climbsFile, "climbs", "olh", "Climbs")
 	flag.BoolVar(&outputJson, "json", false, "Whether to output JSON")
 
+	flag.BoolVar(&clean, "clean", false, "Clean the elevation profiles")
+	flag.Float64Var(&maxGrade, "maxGrade", 0.3, "Steps steeper than this are potential spikes (0 to disable)")
+	flag.Float64Var(&spikeWidth, "spikeWidth", 50, "Maximum width in meters of a spike")
+	flag.StringVar(&filter, "filter", FILTER_MEDIAN, "Smoothing filter (none, mean, median or gaussian)")
+	flag.Float64Var(&window, "window", 30, "Width in meters of the smoothing window")
+	flag.Float64Var(&spacing, "spacing", 0, "Resample points to this spacing in meters (0 to disable)")
+	flag.BoolVar(&reconcile, "reconcile", false, "Rescale elevations to match Strava's low and high")
+	flag.BoolVar(&write, "write", false, "Write the cleaned profiles back to the climbs file (implies -clean)")
+
 	flag.Parse()
 
+	switch filter {
+	case FILTER_NONE, FILTER_MEAN, FILTER_MEDIAN, FILTER_GAUSSIAN:
+	default:
+		exit(fmt.Errorf("unknown filter: %s", filter))
+	}
+	clean = clean || write
+
+	opts := CleanOptions{
+		MaxGrade:   maxGrade,
+		SpikeWidth: spikeWidth,
+		Filter:     filter,
+		Window:     window,
+		Spacing:    spacing,
+		Reconcile:  reconcile,
+	}
+
 	climbs, err := GetClimbs(climbsFile)
 	if err != nil {
 		exit(err)
 	}
 
+	var reports []Report
+	maps := make(map[int64]string)
 	for _, climb := range climbs {
 		s := climb.Segment
 
-		lles, err := geo.DecodeZPolyline(s.Map)
+		res, err := CleanSegment(&s, opts)
+		if err != nil {
+			exit(err)
+		}
+
+		r := Report{
+			Name: climb.Name,
+			ID:   s.ID,
+			Strava: ElevationStats{
+				Distance: s.Distance,
+				Low:      s.ElevationLow,
+				High:     s.ElevationHigh,
+				Gain:     s.TotalElevationGain,
+				Grade:    s.AverageGrade,
+			},
+			Before: res.Before,
+		}
+		if clean {
+			r.After = &res.After
+			maps[s.ID] = res.Map
+		}
+		reports = append(reports, r)
+	}
+
+	if outputJson {
+		j, err := json.MarshalIndent(reports, "", "  ")
 		if err != nil {
 			exit(err)
 		}
+		fmt.Println(string(j))
+	} else {
+		for _, r := range reports {
+			printReport(r)
+		}
+	}
 
-		//d, lo, hi, tot, gr := compute(lls, s.AverageGrade)
-		d, lo, hi, tot, gr := computeZ(lles)
-
-		fmt.Printf("%s\n---\n"+
-			"distance: %.5f (%.5f) = %.5f%%\n"+
-			"low: %.5f (%.5f) = %.5f%%\n"+
-			"high: %.5f (%.5f) = %.5f%%\n"+
-			"gain: %.5f (%.5f) = %.5f%%\n"+
-			"grade: %.5f (%.5f) = %.5f%%\n\n",
-			climb.Name,
-			s.Distance, d, diff(s.Distance, d),
-			s.ElevationLow, lo, diff(s.ElevationLow, lo),
-			s.ElevationHigh, hi, diff(s.ElevationHigh, hi),
-			s.TotalElevationGain, tot, diff(s.TotalElevationGain, tot),
-			s.AverageGrade, gr, diff(s.AverageGrade, gr))
+	if write {
+		err = writeClimbs(Resource(climbsFile), maps)
+		if err != nil {
+			exit(err)
+		}
 	}
 }
 
-func diff(before, after float64) float64 {
-	return (before - after) / before * 100
+func printReport(r Report) {
+	fmt.Printf("%s\n---\n", r.Name)
+	line := func(name string, strava, before float64, after func(*ElevationStats) float64) {
+		fmt.Printf("%s: %.5f (%.5f) = %.5f%%", name, strava, before, diff(strava, before))
+		if r.After != nil {
+			a := after(r.After)
+			fmt.Printf(" -> (%.5f) = %.5f%%", a, diff(strava, a))
+		}
+		fmt.Println()
+	}
+	line("distance", r.Strava.Distance, r.Before.Distance, func(s *ElevationStats) float64 { return s.Distance })
+	line("low", r.Strava.Low, r.Before.Low, func(s *ElevationStats) float64 { return s.Low })
+	line("high", r.Strava.High, r.Before.High, func(s *ElevationStats) float64 { return s.High })
+	line("gain", r.Strava.Gain, r.Before.Gain, func(s *ElevationStats) float64 { return s.Gain })
+	line("grade", r.Strava.Grade, r.Before.Grade, func(s *ElevationStats) float64 { return s.Grade })
+
+	fmt.Printf("points: %d", r.Before.Points)
+	if r.After != nil {
+		fmt.Printf(" -> %d", r.After.Points)
+	}
+	fmt.Printf("\nmax grade: %.2f%%", r.Before.MaxGrade*100)
+	if r.After != nil {
+		fmt.Printf(" -> %.2f%%", r.After.MaxGrade*100)
+	}
+	fmt.Printf("\nspikes: %d", r.Before.Spikes)
+	if r.After != nil {
+		fmt.Printf(" -> %d", r.After.Spikes)
+	}
+	fmt.Printf("\n\n")
 }
 
-func compute(lls []geo.LatLng, gr float64) (d, lo, hi, tot, g float64) {
-	ll := lls[0] // assume len(lls) > 0
-	for i := 1; i < len(lls); i++ {
-		d += distance(ll, lls[i], gr)
-		ll = lls[i]
+// writeClimbs replaces the map of each segment in the climbs file with the
+// cleaned map, preserving everything else about the file.
+func writeClimbs(file string, maps map[int64]string) error {
+	raws, err := ReadObjects(file)
+	if err != nil {
+		return err
 	}
 
-	lo = -1.0
-	hi = -1.0
-	tot = gr * d
-	g = gr
-	return
-}
+	for _, raw := range raws {
+		b, _ := raw.Get("segment")
+		var seg Object
+		err = json.Unmarshal(b, &seg)
+		if err != nil {
+			return err
+		}
 
-func distance(p1, p2 geo.LatLng, gr float64) float64 {
-	run := geo.Distance(p1, p2)
-	// NOTE: Assuming even average gradient for the entire track.
-	rise := gr * run
-	return math.Sqrt(run*run + rise*rise)
-}
+		var s Segment
+		err = json.Unmarshal(b, &s)
+		if err != nil {
+			return err
+		}
+		m, ok := maps[s.ID]
+		if !ok {
+			continue
+		}
+
+		err = seg.Merge(map[string]string{"map": m})
+		if err != nil {
+			return err
+		}
+		b, err = seg.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		raw.Set("segment", b)
+	}
 
-func computeZ(lles []geo.LatLngEle) (d, lo, hi, tot, g float64) {
-	// assume len(lls) > 0
-	lo = lles[0].Ele
-	hi = lo
-	tot = 0.0
-	lle := lles[0]
-	for i := 1; i < len(lles); i++ {
-		dis, gr := distanceZ(lle, lles[i])
-		d += dis
-		g += gr * dis
-
-		tot += lles[i].Ele - lle.Ele
-		lle = lles[i]
-		lo = math.Min(lo, lle.Ele)
-		hi = math.Max(hi, lle.Ele)
+	j, err := json.MarshalIndent(raws, "", "  ")
+	if err != nil {
+		return err
 	}
-	g /= d
-	return
+	return WriteFileAtomic(file, append(j, '\n'))
 }
 
-func distanceZ(p1, p2 geo.LatLngEle) (float64, float64) {
-	run := geo.Distance(p1.LatLng(), p2.LatLng())
-	rise := p2.Ele - p1.Ele
-	return math.Sqrt(run*run + rise*rise), rise / run
+func diff(before, after float64) float64 {
+	return (before - after) / before * 100
 }
 
 func exit(err error) {
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	. "github.com/scheibo/stravutils"
+)
+
+func main() {
+	var merge bool
+	var climbsFiles, format string
+	var opts OverlapOptions
+
+	flag.StringVar(&climbsFiles, "climbs", "climbs", "Comma separated list of climbs to compare")
+	flag.Float64Var(&opts.Tolerance, "tolerance", 50, "distance in m within which segments coincide")
+	flag.Float64Var(&opts.MinOverlap, "overlap", 0.8, "minimum fraction of the shorter segment which must overlap")
+	flag.Float64Var(&opts.MinLengthRatio, "length", 0.5, "minimum ratio of the shorter segment's length to the longer's")
+	flag.Float64Var(&opts.MaxFrechet, "frechet", 100, "maximum Fréchet distance in m for segments to be the same")
+	flag.BoolVar(&merge, "merge", false, "Output the climbs with each cluster merged into its canonical climb")
+	flag.StringVar(&format, "format", "text", "Output format for clusters (text or json)")
+
+	flag.Parse()
+
+	verify("tolerance", opts.Tolerance)
+	verify("overlap", opts.MinOverlap)
+	verify("length", opts.MinLengthRatio)
+	verify("frechet", opts.MaxFrechet)
+
+	var climbs []Climb
+	for _, f := range strings.Split(climbsFiles, ",") {
+		cs, err := GetClimbs(strings.TrimSpace(f))
+		if err != nil {
+			exit(err)
+		}
+		climbs = append(climbs, cs...)
+	}
+
+	clusters, err := ClusterClimbs(climbs, opts)
+	if err != nil {
+		exit(err)
+	}
+
+	if merge {
+		err = outputMerged(climbs, clusters)
+	} else {
+		SortClusters(clusters)
+		switch format {
+		case "json":
+			err = outputJSON(clusters)
+		case "text":
+			err = outputText(clusters, opts)
+		default:
+			err = fmt.Errorf("unknown format: %s", format)
+		}
+	}
+	if err != nil {
+		exit(err)
+	}
+}
+
+func outputText(clusters []Cluster, opts OverlapOptions) error {
+	for _, c := range clusters {
+		canonical := c.Climbs[c.Canonical]
+		fmt.Printf("%s (%d)\n", canonical.Name, canonical.Segment.ID)
+		for i, climb := range c.Climbs {
+			if i == c.Canonical {
+				continue
+			}
+			o, err := CompareSegments(&canonical.Segment, &climb.Segment, opts.Tolerance)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("  %s (%d): overlap %.0f%%, length %.0f%%, Hausdorff %.0fm, Fréchet %.0fm\n",
+				climb.Name, climb.Segment.ID, o.Ratio*100, o.LengthRatio*100, o.Hausdorff, o.Frechet)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func outputJSON(clusters []Cluster) error {
+	j, err := json.MarshalIndent(clusters, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(j))
+	return nil
+}
+
+// outputMerged outputs the climbs with each cluster replaced by its merged
+// canonical climb at the position of the cluster's first climb.
+func outputMerged(climbs []Climb, clusters []Cluster) error {
+	type key struct {
+		id   int64
+		name string
+	}
+
+	merged := make(map[key]*Climb)
+	for i := range clusters {
+		m := clusters[i].Merge()
+		for _, c := range clusters[i].Climbs {
+			merged[key{c.Segment.ID, c.Name}] = &m
+		}
+	}
+
+	var result []Climb
+	done := make(map[*Climb]bool)
+	for _, c := range climbs {
+		m, ok := merged[key{c.Segment.ID, c.Name}]
+		if !ok {
+			result = append(result, c)
+			continue
+		}
+		if !done[m] {
+			done[m] = true
+			result = append(result, *m)
+		}
+	}
+
+	j, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(j))
+	return nil
+}
+
+func verify(s string, x float64) {
+	if x < 0 {
+		exit(fmt.Errorf("%s must be non negative but was %f", s, x))
+	}
+}
+
+func exit(err error) {
+	fmt.Fprintf(os.Stderr, "%s\n\n", err)
+	flag.PrintDefaults()
+	os.Exit(1)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/araddon/dateparse"
+	. "github.com/scheibo/stravutils"
+	"github.com/scheibo/weather"
+)
+
+type TimeFlag struct {
+	Time *time.Time
+}
+
+func (t *TimeFlag) String() string {
+	return fmt.Sprintf("%s", t.Time)
+}
+
+func (t *TimeFlag) Set(v string) error {
+	parsed, err := dateparse.ParseLocal(strings.TrimSpace(v))
+	if err != nil {
+		return err
+	}
+	t.Time = &parsed
+	return nil
+}
+
+func main() {
+	var hist, offline bool
+	var token, climbsFile, riderFile, key, cache, tz, format string
+	var qps int
+	var p, score float64
+	var dur time.Duration
+	var tf TimeFlag
+
+	flag.StringVar(&token, "token", "", "Access Token")
+	flag.StringVar(&climbsFile, "climbs", "", "Climbs")
+	flag.StringVar(&riderFile, "rider", "", "Rider profile")
+	flag.Float64Var(&p, "p", 0, "power maintained for t in a reference effort")
+	flag.DurationVar(&dur, "t", 0, "duration of the reference effort in minutes and seconds ('12m34s')")
+	flag.Float64Var(&score, "perf", 0, "PERF score to predict for instead of the rider's")
+	flag.BoolVar(&hist, "historical", false, "include historical average weather conditions")
+	flag.StringVar(&key, "key", os.Getenv("DARKSKY_API_KEY"), "DarkySky API Key")
+	flag.StringVar(&cache, "cache", "", "cache directory for historical queries")
+	flag.IntVar(&qps, "qps", 100, "maximum queries per second against darksky")
+	flag.BoolVar(&offline, "offline", false, "whether or not to run in offline mode")
+	flag.StringVar(&tz, "tz", "America/Los_Angeles", "timezone to use")
+	flag.Var(&tf, "time", "time to predict the effort for")
+	flag.StringVar(&format, "format", "", "Output format (text or jsonl), defaults to jsonl when piped")
+
+	flag.Parse()
+
+	if format == "" {
+		fi, _ := os.Stdout.Stat()
+		if (fi.Mode() & os.ModeCharDevice) == 0 {
+			format = "jsonl"
+		} else {
+			format = "text"
+		}
+	}
+	if format != "text" && format != "jsonl" {
+		exit(fmt.Errorf("unknown format: %s", format))
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		exit(err)
+	}
+
+	var msgs []*Message
+	fi, _ := os.Stdin.Stat()
+	if len(flag.Args()) == 0 && (fi.Mode()&os.ModeCharDevice) == 0 {
+		msgs, err = ReadMessages(os.Stdin)
+		if err != nil {
+			exit(err)
+		}
+	} else {
+		climbs, err := GetClimbs(climbsFile)
+		if err != nil {
+			exit(err)
+		}
+
+		m := NewMessage()
+		m.Segment, err = FindSegment(climbs, flag.Args(), token)
+		if err != nil {
+			exit(err)
+		}
+		msgs = append(msgs, m)
+	}
+
+	profile, err := GetRider(riderFile)
+	if err != nil {
+		exit(err)
+	}
+
+	var avgs HistoricalClimbAverages
+	if hist {
+		avgs, err = GetHistoricalAverages()
+		if err != nil {
+			exit(err)
+		}
+	}
+
+	w := NewWeatherClient(key, cache, qps, loc, offline)
+	for i, m := range msgs {
+		s := m.Segment
+		if s == nil {
+			exit(fmt.Errorf("segment required"))
+		}
+
+		// Riders passed along from other commands take precedence over the
+		// default profile but not over one explicitly specified.
+		rider := profile
+		if m.Rider != nil && riderFile == "" {
+			rider = m.Rider
+		}
+
+		var pd PowerDuration
+		if p > 0 || dur > 0 {
+			if p <= 0 || dur <= 0 {
+				exit(fmt.Errorf("p and t must both be specified and be > 0"))
+			}
+			pd = rider.ReferencePowerDuration(p, float64(dur/time.Second))
+		} else {
+			sc := score
+			if sc <= 0 {
+				sc = rider.PERF
+			}
+			if sc <= 0 {
+				exit(fmt.Errorf("a reference effort or PERF score is required"))
+			}
+			pd = rider.PERFPowerDuration(sc, s)
+		}
+
+		t := time.Now()
+		if tf.Time != nil {
+			t = *tf.Time
+		} else if m.Time != nil {
+			t = *m.Time
+		}
+
+		c := m.Conditions
+		if c == nil || tf.Time != nil {
+			c, err = w.Conditions(s.AverageLocation, t)
+			if err != nil {
+				exit(err)
+			}
+		}
+
+		still, err := PredictTime(pd, s, nil, rider)
+		if err != nil {
+			exit(err)
+		}
+
+		predicted, err := PredictTime(pd, s, c, rider)
+		if err != nil {
+			exit(err)
+		}
+
+		var past *weather.Conditions
+		if hist {
+			past = avgs.Get(s, t, loc)
+		}
+
+		baseline, historical, err := PowerWNF(pd(predicted), s, c, past)
+		if err != nil {
+			exit(err)
+		}
+
+		if format == "jsonl" {
+			m.Time, m.Conditions, m.Rider = &t, c, rider
+			m.WNF, m.HistoricalWNF = baseline, historical
+			m.Duration, m.Power = predicted, pd(predicted)
+			err = m.Write(os.Stdout)
+			if err != nil {
+				exit(err)
+			}
+			continue
+		}
+
+		if i > 0 {
+			fmt.Println()
+		}
+		h := ""
+		if hist && past != nil {
+			h = fmt.Sprintf("\n%s => %s\n", weatherString(past), displayScore(historical))
+		}
+		fmt.Printf("%s (%s)\n%s\n%s\n\n%s => %s\n%s",
+			s.Name, t.In(loc).Format("Mon Jan _2 3:04PM 2006"),
+			effortString("predicted", predicted, pd(predicted), rider),
+			effortString("still air", still, pd(still), rider),
+			weatherString(c), displayScore(baseline), h)
+	}
+}
+
+func effortString(name string, t, p float64, rider *Rider) string {
+	d := (time.Duration(t) * time.Second).Round(time.Second)
+	return fmt.Sprintf("%s: %s @ %.0fW (%.2f W/kg)", name, d, p, p/rider.Mass)
+}
+
+func displayScore(s float64) string {
+	return fmt.Sprintf("%.2f%%", (s-1)*100)
+}
+
+func weatherString(c *weather.Conditions) string {
+	precip := ""
+	if c.PrecipProbability > 0.1 {
+		precip = fmt.Sprintf("\n%s", c.Precip())
+	}
+	return fmt.Sprintf("%.1f°C (%.3f kg/m³)%s\n%s", c.Temperature, c.AirDensity, precip, c.Wind())
+}
+
+func exit(err error) {
+	fmt.Fprintf(os.Stderr, "%s\n\n", err)
+	flag.PrintDefaults()
+	os.Exit(1)
+}
@@ -5,14 +5,16 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/scheibo/strava"
 	. "github.com/scheibo/stravutils"
 )
 
 func main() {
-	var starred bool
-	var token, climbsFile string
+	var starred, sync, write, yes bool
+	var token, climbsFile, state string
+	var refresh time.Duration
 	var climbs, empty, result []Climb
 	var err error
 
@@ -20,8 +22,34 @@ func main() {
 	flag.StringVar(&token, "token", "", "Access Token")
 	flag.StringVar(&climbsFile, "climbs", "", "Climbs")
 
+	flag.BoolVar(&sync, "sync", false, "Diff the climbs against Strava instead of dumping them")
+	flag.BoolVar(&write, "write", false, "Write approved changes back to the climbs file when syncing")
+	flag.BoolVar(&yes, "yes", false, "Approve all changes without prompting")
+	flag.StringVar(&state, "state", "", "File recording when each segment was last synced")
+	flag.DurationVar(&refresh, "refresh", 0, "Skip segments synced more recently than this (requires -state)")
+
 	flag.Parse()
 
+	if sync {
+		if climbsFile == "" {
+			climbsFile = "climbs"
+		}
+		s := &syncer{
+			token:   token,
+			file:    Resource(climbsFile),
+			state:   state,
+			refresh: refresh,
+			starred: starred,
+			write:   write,
+			yes:     yes,
+		}
+		err = s.sync()
+		if err != nil {
+			exit(err)
+		}
+		return
+	}
+
 	if climbsFile != "" {
 		climbs, err = GetClimbs(climbsFile)
 		if err != nil {
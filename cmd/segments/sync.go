@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/scheibo/geo"
+	. "github.com/scheibo/stravutils"
+)
+
+// EPSILON is the relative difference below which values are considered equal.
+const EPSILON = 1e-4
+
+type entry struct {
+	raw   *Object
+	climb Climb
+}
+
+// Change is a pending update to a single catalog entry.
+type Change struct {
+	index   int // -1 for new entries
+	climb   Climb
+	updated *Segment
+	diffs   []string
+}
+
+func (c *Change) String() string {
+	if c.index < 0 {
+		return fmt.Sprintf("+ %s (%d)\n  %s",
+			c.updated.Name, c.updated.ID, strings.Join(summarize(c.updated), "\n  "))
+	}
+	return fmt.Sprintf("~ %s (%d)\n  %s", c.climb.Name, c.climb.Segment.ID, strings.Join(c.diffs, "\n  "))
+}
+
+type syncer struct {
+	token   string
+	file    string
+	state   string
+	refresh time.Duration
+	starred bool
+	write   bool
+	yes     bool
+	synced  map[int64]time.Time
+}
+
+func (s *syncer) sync() error {
+	raws, err := ReadObjects(s.file)
+	if err != nil {
+		return err
+	}
+
+	var entries []entry
+	for _, raw := range raws {
+		var c Climb
+		b, err := raw.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(b, &c)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{raw, c})
+	}
+
+	err = s.loadState()
+	if err != nil {
+		return err
+	}
+
+	var empty []Climb
+	var changes []*Change
+	known := make(map[int64]bool)
+	now := time.Now()
+
+	for i, e := range entries {
+		known[e.climb.Segment.ID] = true
+		if t, ok := s.synced[e.climb.Segment.ID]; ok && s.refresh > 0 && now.Sub(t) < s.refresh {
+			continue
+		}
+
+		updated, err := GetSegmentByID(e.climb.Segment.ID, empty, s.token)
+		if err != nil {
+			return err
+		}
+
+		diffs, err := diff(&e.climb.Segment, updated)
+		if err != nil {
+			return err
+		}
+		// Segments with changes are only synced once the changes are applied.
+		if len(diffs) > 0 {
+			changes = append(changes, &Change{index: i, climb: e.climb, updated: updated, diffs: diffs})
+		} else {
+			s.synced[updated.ID] = now
+		}
+	}
+
+	if s.starred {
+		stars, err := GetStarred(s.token)
+		if err != nil {
+			return err
+		}
+
+		for _, star := range stars {
+			if known[star.Id] {
+				continue
+			}
+			known[star.Id] = true
+
+			// Obnoxiously, we need the SegmentDetailed for TotalElevatioGain
+			ns, err := GetSegmentByID(star.Id, empty, s.token)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, &Change{index: -1, updated: ns})
+		}
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("No changes.")
+		return s.saveState()
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	approved := 0
+	for _, c := range changes {
+		fmt.Printf("%s\n\n", c)
+		if !s.write {
+			continue
+		}
+
+		ok := s.yes
+		if !ok {
+			ok, err = prompt(in, "Apply? [y/N] ")
+			if err != nil {
+				return err
+			}
+		}
+		if !ok {
+			continue
+		}
+		approved++
+		s.synced[c.updated.ID] = now
+
+		if c.index < 0 {
+			raw := NewObject()
+			err = raw.Merge(Climb{Name: c.updated.Name, Segment: *c.updated})
+			if err != nil {
+				return err
+			}
+			raws = append(raws, raw)
+			continue
+		}
+
+		// Only the segment is refreshed from Strava, local names and aliases and
+		// any fields we don't know about are preserved.
+		raw := raws[c.index]
+		b, _ := raw.Get("segment")
+		var seg Object
+		err = json.Unmarshal(b, &seg)
+		if err != nil {
+			return err
+		}
+		err = seg.Merge(c.updated)
+		if err != nil {
+			return err
+		}
+		b, err = seg.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		raw.Set("segment", b)
+	}
+
+	if !s.write {
+		return nil
+	}
+
+	if approved > 0 {
+		j, err := json.MarshalIndent(raws, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = WriteFileAtomic(s.file, append(j, '\n'))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d/%d changes to %s\n", approved, len(changes), s.file)
+	}
+
+	return s.saveState()
+}
+
+func (s *syncer) loadState() error {
+	s.synced = make(map[int64]time.Time)
+	if s.state == "" {
+		return nil
+	}
+
+	f, err := ioutil.ReadFile(s.state)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(f, &s.synced)
+}
+
+func (s *syncer) saveState() error {
+	if s.state == "" || !s.write {
+		return nil
+	}
+
+	j, err := json.MarshalIndent(s.synced, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(s.state, j)
+}
+
+// diff returns a human-readable description of each difference between the
+// Strava derived fields of the segments before and after.
+func diff(before, after *Segment) ([]string, error) {
+	var diffs []string
+
+	number := func(name string, b, a float64, format string) {
+		if !equal(b, a) {
+			diffs = append(diffs, fmt.Sprintf("%s: "+format+" -> "+format, name, b, a))
+		}
+	}
+	location := func(name string, b, a geo.LatLng) {
+		if d := geo.Distance(b, a); d > 1 {
+			diffs = append(diffs, fmt.Sprintf("%s: %s -> %s (%.1fm)", name, b.String(), a.String(), d))
+		}
+	}
+
+	if before.Name != after.Name {
+		diffs = append(diffs, fmt.Sprintf("name: %q -> %q", before.Name, after.Name))
+	}
+	number("distance", before.Distance, after.Distance, "%.2fm")
+	number("average_grade", before.AverageGrade*100, after.AverageGrade*100, "%.2f%%")
+	number("elevation_low", before.ElevationLow, after.ElevationLow, "%.1fm")
+	number("elevation_high", before.ElevationHigh, after.ElevationHigh, "%.1fm")
+	number("total_elevation_gain", before.TotalElevationGain, after.TotalElevationGain, "%.1fm")
+	number("median_elevation", before.MedianElevation, after.MedianElevation, "%.1fm")
+	location("start_location", before.StartLocation, after.StartLocation)
+	location("end_location", before.EndLocation, after.EndLocation)
+
+	if before.Map != after.Map {
+		d, err := mapDiff(before.Map, after.Map)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, d)
+	}
+
+	return diffs, nil
+}
+
+func mapDiff(before, after string) (string, error) {
+	if before == "" {
+		return "map: added", nil
+	}
+
+	b, err := geo.DecodeZPolyline(before)
+	if err != nil {
+		return "", err
+	}
+	a, err := geo.DecodeZPolyline(after)
+	if err != nil {
+		return "", err
+	}
+
+	// The largest distance from any new point to the closest of the old points.
+	max, ele := 0.0, 0.0
+	for _, p := range a {
+		min, e := math.Inf(1), 0.0
+		for _, q := range b {
+			if d := geo.Distance(p.LatLng(), q.LatLng()); d < min {
+				min, e = d, math.Abs(p.Ele-q.Ele)
+			}
+		}
+		max, ele = math.Max(max, min), math.Max(ele, e)
+	}
+
+	return fmt.Sprintf("map: %d -> %d points (max %.1fm apart, %.1fm elevation)",
+		len(b), len(a), max, ele), nil
+}
+
+func summarize(s *Segment) []string {
+	return []string{
+		fmt.Sprintf("distance: %.2fm", s.Distance),
+		fmt.Sprintf("average_grade: %.2f%%", s.AverageGrade*100),
+		fmt.Sprintf("total_elevation_gain: %.1fm", s.TotalElevationGain),
+	}
+}
+
+func equal(a, b float64) bool {
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b)/math.Max(math.Abs(a), math.Abs(b)) < EPSILON
+}
+
+func prompt(in *bufio.Reader, q string) (bool, error) {
+	fmt.Print(q)
+	line, err := in.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	line = strings.ToLower(strings.TrimSpace(line))
+	return line == "y" || line == "yes", nil
+}
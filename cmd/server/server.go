@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/araddon/dateparse"
+	"github.com/scheibo/perf"
+	. "github.com/scheibo/stravutils"
+	"github.com/scheibo/weather"
+)
+
+// DEFAULT_RESULTS is the number of search results returned if unspecified.
+const DEFAULT_RESULTS = 10
+
+type server struct {
+	climbs Catalog
+	index  *SearchIndex
+	avgs   HistoricalClimbAverages
+	w      *Weather
+	loc    *time.Location
+	token  string
+
+	mu sync.Mutex
+	// Segments which aren't in the catalog, cached after being fetched.
+	fetched map[int64]*Segment
+}
+
+// httpError is an error with the HTTP status code it should be reported with.
+type httpError struct {
+	status int
+	err    error
+	// Optional extra information to include in the response.
+	details interface{}
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(err error) error {
+	return &httpError{status: http.StatusBadRequest, err: err}
+}
+
+func notFound(err error) error {
+	return &httpError{status: http.StatusNotFound, err: err}
+}
+
+// Conditions are the weather conditions for a segment at a time.
+type Conditions struct {
+	Segment    *Segment            `json:"segment"`
+	Time       time.Time           `json:"time"`
+	Conditions *weather.Conditions `json:"conditions"`
+}
+
+// Score is the wind normalization factor for a segment at a time and power.
+type Score struct {
+	Segment     *Segment            `json:"segment"`
+	Time        time.Time           `json:"time"`
+	Power       float64             `json:"power"`
+	Baseline    float64             `json:"baseline"`
+	Historical  float64             `json:"historical,omitempty"`
+	Conditions  *weather.Conditions `json:"conditions"`
+	Climatology *weather.Conditions `json:"climatology,omitempty"`
+}
+
+// Climatology is the historical average conditions for a segment, either for
+// every month and hour or for a specific time.
+type Climatology struct {
+	Segment    *Segment                   `json:"segment"`
+	Time       *time.Time                 `json:"time,omitempty"`
+	Conditions *weather.Conditions        `json:"conditions,omitempty"`
+	Monthly    *HistoricalMonthlyAverages `json:"monthly,omitempty"`
+}
+
+func main() {
+	var offline bool
+	var addr, token, climbsFile, historicalFile, key, cache, tz string
+	var qps int
+
+	flag.StringVar(&addr, "addr", "localhost:8080", "Address to listen on")
+	flag.StringVar(&token, "token", "", "Access Token")
+	flag.StringVar(&climbsFile, "climbs", "", "Climbs")
+	flag.StringVar(&historicalFile, "historical", "", "Historical average weather conditions")
+	flag.StringVar(&key, "key", os.Getenv("DARKSKY_API_KEY"), "DarkySky API Key")
+	flag.StringVar(&cache, "cache", "", "cache directory for historical queries")
+	flag.IntVar(&qps, "qps", 100, "maximum queries per second against darksky")
+	flag.BoolVar(&offline, "offline", false, "whether or not to run in offline mode")
+	flag.StringVar(&tz, "tz", "America/Los_Angeles", "timezone to use")
+
+	flag.Parse()
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		exit(err)
+	}
+
+	climbs, err := GetClimbs(climbsFile)
+	if err != nil {
+		exit(err)
+	}
+
+	avgs, err := GetHistoricalAverages(historicalFile)
+	if err != nil {
+		exit(err)
+	}
+
+	s := &server{
+		climbs: climbs,
+		index:  NewSearchIndex(climbs),
+		avgs:   avgs,
+		w:      NewWeatherClient(key, cache, qps, loc, offline),
+		loc:    loc,
+		token:  token,
+
+		fetched: make(map[int64]*Segment),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/segments", handler(s.segments))
+	mux.Handle("/segments/", handler(s.segment))
+
+	log.Printf("Listening on %s", addr)
+	exit(http.ListenAndServe(addr, mux))
+}
+
+// handler adapts a function returning a value to be encoded as JSON or an
+// error into an http.Handler.
+func handler(f func(r *http.Request) (interface{}, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			respond(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		v, err := f(r)
+		if err != nil {
+			status := http.StatusInternalServerError
+			body := map[string]interface{}{"error": err.Error()}
+			if he, ok := err.(*httpError); ok {
+				status = he.status
+				if he.details != nil {
+					body["details"] = he.details
+				}
+			}
+			if status == http.StatusInternalServerError {
+				log.Printf("%s %s: %s", r.Method, r.URL, err)
+			}
+			respond(w, status, body)
+			return
+		}
+		respond(w, http.StatusOK, v)
+	})
+}
+
+func respond(w http.ResponseWriter, status int, v interface{}) {
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "{\"error\": %q}\n", err.Error())
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(j)
+	w.Write([]byte("\n"))
+}
+
+// segments handles '/segments', searching the climbs if 'search' is
+// provided, querying them if 'q' is provided or otherwise listing them.
+func (s *server) segments(r *http.Request) (interface{}, error) {
+	params := r.URL.Query()
+
+	if search := params.Get("search"); search != "" {
+		n := DEFAULT_RESULTS
+		if v := params.Get("n"); v != "" {
+			var err error
+			n, err = strconv.Atoi(v)
+			if err != nil {
+				return nil, badRequest(err)
+			}
+		}
+		return s.index.Search(search, n), nil
+	}
+
+	if query := params.Get("q"); query != "" {
+		q, err := ParseQuery(query)
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		return s.climbs.Query(q), nil
+	}
+
+	return s.climbs, nil
+}
+
+// segment handles '/segments/{segment}[/{resource}]', where segment is either
+// an ID or a name.
+func (s *server) segment(r *http.Request) (interface{}, error) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/segments/"), "/"), "/")
+	if len(parts) > 2 || parts[0] == "" {
+		return nil, notFound(fmt.Errorf("not found: %s", r.URL.Path))
+	}
+
+	seg, err := s.find(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parts) == 1 {
+		return seg, nil
+	}
+
+	params := r.URL.Query()
+	switch parts[1] {
+	case "profile":
+		p, err := Profile(seg)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	case "conditions":
+		t, c, err := s.conditions(seg, params.Get("time"))
+		if err != nil {
+			return nil, err
+		}
+		return &Conditions{Segment: seg, Time: t, Conditions: c}, nil
+	case "wnf":
+		return s.wnf(seg, params.Get("time"), params.Get("power"))
+	case "climatology":
+		return s.climatology(seg, params.Get("time"))
+	default:
+		return nil, notFound(fmt.Errorf("not found: %s", r.URL.Path))
+	}
+}
+
+func (s *server) find(arg string) (*Segment, error) {
+	if id, err := strconv.ParseInt(arg, 10, 0); err == nil {
+		return s.segmentByID(id)
+	}
+
+	seg, err := s.index.Find(arg)
+	if err != nil {
+		if ambiguous, ok := err.(*AmbiguousError); ok {
+			return nil, &httpError{status: http.StatusNotFound, err: err, details: ambiguous.Candidates}
+		}
+		return nil, err
+	}
+	return seg, nil
+}
+
+// segmentByID returns the segment from the catalog, or fetches it from Strava
+// and caches it if it is not one of the climbs.
+func (s *server) segmentByID(id int64) (*Segment, error) {
+	for i := range s.climbs {
+		if s.climbs[i].Segment.ID == id {
+			return &s.climbs[i].Segment, nil
+		}
+	}
+
+	s.mu.Lock()
+	seg, ok := s.fetched[id]
+	s.mu.Unlock()
+	if ok {
+		return seg, nil
+	}
+
+	seg, err := GetSegmentByID(id, nil, s.token)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.fetched[id] = seg
+	s.mu.Unlock()
+	return seg, nil
+}
+
+// conditions returns the conditions for the segment at the time, or
+// currently if no time is specified.
+func (s *server) conditions(seg *Segment, v string) (time.Time, *weather.Conditions, error) {
+	if v == "" {
+		c, err := s.w.Current(seg.AverageLocation)
+		return time.Now().In(s.loc), c, err
+	}
+
+	t, err := s.parseTime(v)
+	if err != nil {
+		return t, nil, err
+	}
+	c, err := s.w.Conditions(seg.AverageLocation, t)
+	return t, c, err
+}
+
+func (s *server) wnf(seg *Segment, tv, pv string) (interface{}, error) {
+	t, c, err := s.conditions(seg, tv)
+	if err != nil {
+		return nil, err
+	}
+
+	power := perf.CalcPowerM(500, seg.Distance, seg.AverageGrade, seg.MedianElevation)
+	if pv != "" {
+		power, err = strconv.ParseFloat(pv, 64)
+		if err != nil || power <= 0 {
+			return nil, badRequest(fmt.Errorf("invalid power: %s", pv))
+		}
+	}
+
+	past := s.avgs.Get(seg, t, s.loc)
+	baseline, historical, err := PowerWNF(power, seg, c, past)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Score{
+		Segment:     seg,
+		Time:        t,
+		Power:       power,
+		Baseline:    baseline,
+		Historical:  historical,
+		Conditions:  c,
+		Climatology: past,
+	}, nil
+}
+
+func (s *server) climatology(seg *Segment, v string) (interface{}, error) {
+	monthly, ok := s.avgs[seg.ID]
+	if !ok {
+		return nil, notFound(fmt.Errorf("no historical averages for segment %d", seg.ID))
+	}
+
+	if v == "" {
+		return &Climatology{Segment: seg, Monthly: &monthly}, nil
+	}
+
+	t, err := s.parseTime(v)
+	if err != nil {
+		return nil, err
+	}
+	return &Climatology{Segment: seg, Time: &t, Conditions: s.avgs.Get(seg, t, s.loc)}, nil
+}
+
+func (s *server) parseTime(v string) (time.Time, error) {
+	t, err := dateparse.ParseIn(strings.TrimSpace(v), s.loc)
+	if err != nil {
+		return t, badRequest(err)
+	}
+	return t, nil
+}
+
+func exit(err error) {
+	fmt.Fprintf(os.Stderr, "%s\n\n", err)
+	flag.PrintDefaults()
+	os.Exit(1)
+}
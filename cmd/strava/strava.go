@@ -5,113 +5,136 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"regexp"
-	"strconv"
-	"strings"
+	"text/tabwriter"
 
-	"github.com/scheibo/fuzzy"
 	. "github.com/scheibo/stravutils"
+	"github.com/scheibo/weather"
 )
 
-const THRESHOLD = 0.6
-
-var alphanum = regexp.MustCompile("[^a-zA-Z0-9]+")
-
 func main() {
-	var token, climbsFile string
+	var token, climbsFile, query, format string
 	var outputJson bool
 
 	flag.StringVar(&token, "token", "", "Access Token")
 	flag.StringVar(&climbsFile, "climbs", "", "Climbs")
 	flag.BoolVar(&outputJson, "json", false, "Whether to output JSON")
+	flag.StringVar(&query, "q", "", "Query for climbs, eg. 'near 37.40,-122.25 within 10km grade>7% sort distance'")
+	flag.StringVar(&format, "format", "", "Output format (json, table, jsonl or flags), defaults to jsonl when piped")
 
 	flag.Parse()
 	args := flag.Args()
 
-	climbs, err := GetClimbs(climbsFile)
-	if err != nil {
-		exit(err)
+	if outputJson {
+		format = "json"
+	}
+	if format == "" {
+		fi, _ := os.Stdout.Stat()
+		if (fi.Mode() & os.ModeCharDevice) == 0 {
+			format = "jsonl"
+		} else if query != "" {
+			format = "table"
+		} else {
+			format = "json"
+		}
 	}
 
-	s, err := findSegment(token, climbs, args)
+	climbs, err := GetClimbs(climbsFile)
 	if err != nil {
 		exit(err)
 	}
 
-	fi, _ := os.Stdout.Stat()
-	if outputJson || (fi.Mode()&os.ModeCharDevice) != 0 {
-		j, err := json.MarshalIndent(s, "", "  ")
+	if query != "" {
+		q, err := ParseQuery(query)
 		if err != nil {
 			exit(err)
 		}
-		fmt.Println(string(j))
-	} else {
-		fmt.Printf("-d=%.2f -e=%.2f -h=%.2f\n",
-			s.Distance, s.TotalElevationGain, s.MedianElevation)
+		matches := Catalog(climbs).Query(q)
+		switch format {
+		case "json":
+			err = outputMatchesJSON(matches)
+		case "table":
+			err = outputMatchesTable(matches, q.Near != nil)
+		default:
+			for _, m := range matches {
+				s := m.Climb.Segment
+				err = output(&s, format)
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			exit(err)
+		}
+		return
 	}
-}
 
-func findSegment(token string, climbs []Climb, args []string) (*Segment, error) {
-	argc := len(args)
-	if argc == 1 {
-		id, err := strconv.ParseInt(args[0], 10, 0)
-		if err == nil {
-			return GetSegmentByID(id, climbs, token)
+	s, err := FindSegment(climbs, args, token)
+	if err != nil {
+		if ambiguous, ok := err.(*AmbiguousError); ok && len(ambiguous.Candidates) > 0 {
+			fmt.Fprintf(os.Stderr, "%s\n", ambiguous)
+			os.Exit(1)
 		}
+		exit(err)
 	}
 
-	var names []string
-	namedClimbs := make(map[string]Climb)
-
-	for _, c := range climbs {
-		n := simplify(c.Name, argc > 0)
-		namedClimbs[n] = c
-		names = append(names, n)
-
-		n = simplify(c.Segment.Name, argc > 0)
-		namedClimbs[n] = c
-		names = append(names, n)
-
-		for _, alias := range c.Aliases {
-			a := simplify(alias, argc > 0)
-			namedClimbs[a] = c
-			names = append(names, a)
-		}
+	err = output(s, format)
+	if err != nil {
+		exit(err)
 	}
+}
+
+func output(s *Segment, format string) error {
+	e := NewMessage()
+	e.Segment = s
 
-	if argc == 0 {
-		m, err := fuzzy.FzfMatch(names)
+	switch format {
+	case "table":
+		return outputMatchesTable([]Match{{Climb: Climb{Name: s.Name, Segment: *s}}}, false)
+	case "json":
+		j, err := json.MarshalIndent(s, "", "  ")
 		if err != nil {
-			return nil, fmt.Errorf("could not find a segment: %s", err)
-		}
-		c, ok := namedClimbs[m]
-		if !ok {
-			return nil, fmt.Errorf("could not find a segment matching: %s", m)
+			return err
 		}
-		return &c.Segment, nil
-	}
-
-	arg := simplify(strings.Join(args, " "), true)
-	exact, ok := namedClimbs[arg]
-	if ok {
-		return &exact.Segment, nil
+		fmt.Println(string(j))
+	case "jsonl":
+		return e.Write(os.Stdout)
+	case "flags":
+		fmt.Println(e.Flags())
+	default:
+		return fmt.Errorf("unknown format: %s", format)
 	}
+	return nil
+}
 
-	m, t := fuzzy.Match(arg, names)
-	if t >= THRESHOLD {
-		closest := namedClimbs[m]
-		return &closest.Segment, nil
+func outputMatchesJSON(matches []Match) error {
+	j, err := json.MarshalIndent(matches, "", "  ")
+	if err != nil {
+		return err
 	}
-
-	return nil, fmt.Errorf("could not find a segment matching: %s", args)
+	fmt.Println(string(j))
+	return nil
 }
 
-func simplify(name string, a bool) string {
-	if a {
-		return strings.ToLower(alphanum.ReplaceAllString(name, ""))
-	} else {
-		return name
+func outputMatchesTable(matches []Match, near bool) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "NAME\tID\tDISTANCE\tGRADE\tGAIN\tELEVATION\tDIRECTION"
+	if near {
+		header += "\tAWAY"
+	}
+	fmt.Fprintln(w, header)
+
+	for _, m := range matches {
+		s := m.Climb.Segment
+		row := fmt.Sprintf("%s\t%d\t%.2fkm\t%.1f%%\t%.0fm\t%.0fm\t%s",
+			m.Climb.Name, s.ID, s.Distance/1000, s.AverageGrade*100,
+			s.TotalElevationGain, s.MedianElevation, weather.Direction(s.AverageDirection))
+		if near {
+			row += fmt.Sprintf("\t%.1fkm", m.Distance/1000)
+		}
+		fmt.Fprintln(w, row)
 	}
+	return w.Flush()
 }
 
 func exit(err error) {
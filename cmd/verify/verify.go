@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/araddon/dateparse"
+	. "github.com/scheibo/stravutils"
+)
+
+// LeadStats are the errors of forecasts made with a lead time in hours in
+// [Min, Max).
+type LeadStats struct {
+	Min float64 `json:"min_hours"`
+	Max float64 `json:"max_hours"`
+	ErrorStats
+}
+
+// ClimbStats are the errors of the forecasts for a segment.
+type ClimbStats struct {
+	Segment *Segment `json:"segment"`
+	ErrorStats
+}
+
+// Report is the verification of the archived forecasts.
+type Report struct {
+	Overall ErrorStats    `json:"overall"`
+	ByLead  []*LeadStats  `json:"by_lead,omitempty"`
+	ByClimb []*ClimbStats `json:"by_climb,omitempty"`
+	// The number of forecasted hours whose conditions could not be observed.
+	Unobserved int `json:"unobserved"`
+}
+
+func main() {
+	var archive, key, cache, tz, since, until, by, format string
+	var qps int
+	var offline bool
+	var lead, bucket time.Duration
+	var minSpeed float64
+
+	flag.StringVar(&archive, "archive", "", "Directory of forecasts archived by windsock")
+	flag.StringVar(&key, "key", os.Getenv("DARKSKY_API_KEY"), "DarkySky API Key")
+	flag.StringVar(&cache, "cache", "", "cache directory for historical queries")
+	flag.IntVar(&qps, "qps", 100, "maximum queries per second against darksky")
+	flag.BoolVar(&offline, "offline", false, "whether or not to run in offline mode")
+	flag.StringVar(&tz, "tz", "America/Los_Angeles", "timezone to use")
+	flag.StringVar(&since, "since", "", "Only verify forecasts generated at or after this time")
+	flag.StringVar(&until, "until", "", "Only verify forecasts generated at or before this time")
+	flag.DurationVar(&lead, "lead", 7*24*time.Hour, "Maximum lead time of the forecasted hours to verify")
+	flag.DurationVar(&bucket, "bucket", 24*time.Hour, "Width of the lead time buckets")
+	flag.Float64Var(&minSpeed, "minSpeed", 1, "Minimum observed wind speed in m/s to compare bearings at")
+	flag.StringVar(&by, "by", "lead,climb", "Comma separated breakdowns of the errors to report: 'lead' and/or 'climb'")
+	flag.StringVar(&format, "format", "text", "Output format (text or json)")
+
+	flag.Parse()
+
+	if archive == "" {
+		exit(fmt.Errorf("archive is required"))
+	}
+	if format != "text" && format != "json" {
+		exit(fmt.Errorf("unknown format: %s", format))
+	}
+	if bucket <= 0 {
+		exit(fmt.Errorf("bucket must be positive but got %s", bucket))
+	}
+	byLead, byClimb := false, false
+	for _, b := range strings.Split(by, ",") {
+		switch strings.TrimSpace(b) {
+		case "lead":
+			byLead = true
+		case "climb":
+			byClimb = true
+		case "":
+		default:
+			exit(fmt.Errorf("unknown breakdown: %s", b))
+		}
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		exit(err)
+	}
+
+	var s, u time.Time
+	if since != "" {
+		s, err = dateparse.ParseIn(since, loc)
+		if err != nil {
+			exit(err)
+		}
+	}
+	if until != "" {
+		u, err = dateparse.ParseIn(until, loc)
+		if err != nil {
+			exit(err)
+		}
+	}
+
+	archives, err := ReadForecastArchives(archive, s, u)
+	if err != nil {
+		exit(err)
+	}
+
+	w := NewWeatherClient(key, cache, qps, loc, offline)
+	samples, unobserved, err := w.Verify(archives, time.Now(), lead)
+	if err != nil {
+		exit(err)
+	}
+	if unobserved > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d forecasted hours whose conditions could not be observed\n", unobserved)
+	}
+	if len(samples) == 0 {
+		exit(fmt.Errorf("no archived forecasts for hours which have been observed"))
+	}
+
+	report := &Report{Overall: NewErrorStats(samples, minSpeed), Unobserved: unobserved}
+	if byLead {
+		report.ByLead = leadStats(samples, bucket, minSpeed)
+	}
+	if byClimb {
+		report.ByClimb = climbStats(samples, minSpeed)
+	}
+
+	if format == "json" {
+		j, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			exit(err)
+		}
+		fmt.Println(string(j))
+		return
+	}
+
+	err = output(report)
+	if err != nil {
+		exit(err)
+	}
+}
+
+func leadStats(samples []*VerificationSample, bucket time.Duration, minSpeed float64) []*LeadStats {
+	buckets := make(map[int][]*VerificationSample)
+	for _, s := range samples {
+		b := int(s.Lead / bucket)
+		buckets[b] = append(buckets[b], s)
+	}
+
+	var keys []int
+	for b := range buckets {
+		keys = append(keys, b)
+	}
+	sort.Ints(keys)
+
+	var stats []*LeadStats
+	for _, b := range keys {
+		stats = append(stats, &LeadStats{
+			Min:        (time.Duration(b) * bucket).Hours(),
+			Max:        (time.Duration(b+1) * bucket).Hours(),
+			ErrorStats: NewErrorStats(buckets[b], minSpeed),
+		})
+	}
+	return stats
+}
+
+func climbStats(samples []*VerificationSample, minSpeed float64) []*ClimbStats {
+	segments := make(map[int64]*Segment)
+	climbs := make(map[int64][]*VerificationSample)
+	for _, s := range samples {
+		segments[s.Segment.ID] = s.Segment
+		climbs[s.Segment.ID] = append(climbs[s.Segment.ID], s)
+	}
+
+	var stats []*ClimbStats
+	for id, ss := range climbs {
+		stats = append(stats, &ClimbStats{Segment: segments[id], ErrorStats: NewErrorStats(ss, minSpeed)})
+	}
+	// Climbs whose scores are least trustworthy first.
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].WNFMAE > stats[j].WNFMAE
+	})
+	return stats
+}
+
+func output(report *Report) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	header := "\tN\tSPEED BIAS\tSPEED MAE\tSPEED RMSE\tBEARING MAE\tDENSITY BIAS\tDENSITY MAE\tWNF BIAS\tWNF MAE\tWNF RMSE\t"
+
+	if len(report.ByLead) > 0 {
+		fmt.Fprintln(tw, "LEAD"+header)
+		for _, l := range report.ByLead {
+			fmt.Fprintf(tw, "%s\t%s\n", formatLead(l.Min, l.Max), row(&l.ErrorStats))
+		}
+		fmt.Fprintf(tw, "ALL\t%s\n", row(&report.Overall))
+		fmt.Fprintln(tw)
+	}
+
+	if len(report.ByClimb) > 0 {
+		fmt.Fprintln(tw, "CLIMB"+header)
+		for _, c := range report.ByClimb {
+			fmt.Fprintf(tw, "%s\t%s\n", c.Segment.Name, row(&c.ErrorStats))
+		}
+		fmt.Fprintf(tw, "ALL\t%s\n", row(&report.Overall))
+	}
+
+	if len(report.ByLead) == 0 && len(report.ByClimb) == 0 {
+		fmt.Fprintln(tw, header[1:])
+		fmt.Fprintf(tw, "%s\n", row(&report.Overall))
+	}
+	return tw.Flush()
+}
+
+func row(st *ErrorStats) string {
+	bearing := "-"
+	if st.BearingN > 0 {
+		bearing = fmt.Sprintf("%.0f°", st.BearingMAE)
+	}
+	return fmt.Sprintf("%d\t%+.1f km/h\t%.1f km/h\t%.1f km/h\t%s\t%+.3f\t%.3f\t%+.2f%%\t%.2f%%\t%.2f%%\t",
+		st.N, st.WindSpeedBias*msToKmh, st.WindSpeedMAE*msToKmh, st.WindSpeedRMSE*msToKmh, bearing,
+		st.AirDensityBias, st.AirDensityMAE, st.WNFBias, st.WNFMAE, st.WNFRMSE)
+}
+
+func formatLead(min, max float64) string {
+	return fmt.Sprintf("%.0f-%.0fh", min, max)
+}
+
+const msToKmh = 3600.0 / 1000.0
+
+func exit(err error) {
+	fmt.Fprintf(os.Stderr, "%s\n\n", err)
+	flag.PrintDefaults()
+	os.Exit(1)
+}
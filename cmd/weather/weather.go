@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/araddon/dateparse"
@@ -54,16 +55,17 @@ func (ll *LatLngFlag) Set(v string) error {
 //
 
 // COMPUTE WNF scores for climb (or if no climb, general score for latlng at time). if --historical, do historical lookup and use Time2 instead
-// output: if piped, params (no historical params? calc will choke), otherwise condtions + score
+// input: messages (or bare segments) from stdin, one per line, or climbs as arguments
+// output: if piped, messages with the conditions and scores (or params with -format=flags), otherwise condtions + score
+// -best: rank the forecasted hours of the next -days days for the climbs instead
+// -all or -q: rank every climb in the catalog (or matching the query) by its scores at the time instead
 
 func main() {
-	var hist, offline bool
-	var key, cache, tz string
-	var qps int
+	var hist, offline, best, daylight, all bool
+	var token, climbsFile, key, cache, tz, format, rank, query string
+	var qps, days, min, max, n, parallel int
 	var tf TimeFlag
 	var llf LatLngFlag
-	var t time.Time
-	var ll *geo.LatLng
 
 	flag.BoolVar(&hist, "historical", false, "include historical average weather conditions")
 	flag.StringVar(&key, "key", os.Getenv("DARKSKY_API_KEY"), "DarkySky API Key")
@@ -73,13 +75,39 @@ func main() {
 	flag.StringVar(&tz, "tz", "America/Los_Angeles", "timezone to use")
 	flag.Var(&llf, "latlng", "latitude and longitude to query weather information for")
 	flag.Var(&tf, "time", "time to query weather information for")
+	flag.StringVar(&format, "format", "", "Output format (text, json, jsonl or flags), defaults to jsonl when piped")
+	flag.StringVar(&token, "token", "", "Access Token")
+	flag.StringVar(&climbsFile, "climbs", "", "Climbs")
+
+	flag.BoolVar(&best, "best", false, "Find the best forecasted windows for the climbs")
+	flag.IntVar(&days, "days", 2, "Number of days ahead to consider with -best")
+	flag.IntVar(&min, "min", 6, "Minimum hour [0-23] to consider with -best")
+	flag.IntVar(&max, "max", 18, "Maximum hour [0-23] to consider with -best")
+	flag.BoolVar(&daylight, "daylight", false, "Only consider hours between sunrise and sunset with -best")
+	flag.IntVar(&n, "n", 10, "Number of windows to output with -best")
+	flag.StringVar(&rank, "rank", "baseline", "Rank by 'baseline' or 'historical' WNF with -best, -all or -q")
+
+	flag.BoolVar(&all, "all", false, "Score every climb in the catalog at the time")
+	flag.StringVar(&query, "q", "", "Score the climbs matching the query at the time, eg. 'near 37.40,-122.25 within 10km'")
+	flag.IntVar(&parallel, "parallel", 8, "Maximum number of climbs to query for at once with -all or -q")
 
 	flag.Parse()
 
-	if tf.Time != nil {
-		t = *tf.Time
-	} else {
-		t = time.Now()
+	ranked := all || query != ""
+
+	if format == "" {
+		fi, _ := os.Stdout.Stat()
+		if (fi.Mode() & os.ModeCharDevice) == 0 {
+			format = "jsonl"
+		} else {
+			format = "text"
+		}
+	}
+	if format != "text" && format != "jsonl" && format != "flags" && !(format == "json" && (best || ranked)) {
+		exit(fmt.Errorf("unknown format: %s", format))
+	}
+	if rank != "baseline" && rank != "historical" {
+		exit(fmt.Errorf("unknown rank: %s", rank))
 	}
 
 	loc, err := time.LoadLocation(tz)
@@ -87,7 +115,7 @@ func main() {
 		exit(err)
 	}
 
-	var s Segment
+	var msgs []*Message
 	var extra string
 
 	fi, _ := os.Stdin.Stat()
@@ -97,78 +125,280 @@ func main() {
 			exit(err)
 		}
 
-		err = json.Unmarshal(bytes, &s)
+		msgs, err = ParseMessages(bytes)
 		if err != nil {
+			// Legacy flags from another command which are passed through.
 			extra = strings.TrimSpace(string(bytes))
 		}
 	}
 
+	w := NewWeatherClient(key, cache, qps, loc, offline)
 	if llf.LatLng != nil {
-		ll = llf.LatLng
+		t := time.Now()
+		if tf.Time != nil {
+			t = *tf.Time
+		}
+		c, err := w.Conditions(*llf.LatLng, t)
+		if err != nil {
+			exit(err)
+		}
+
+		m := NewMessage()
+		m.Time, m.Conditions = &t, c
+		switch format {
+		case "flags":
+			// Remove -h=... from the end of extra so that it doesn't conflict with rho
+			h := strings.LastIndex(extra, " ")
+			if h > 0 {
+				extra = extra[:h]
+			}
+			// NOTE: must specify -db!
+			fmt.Printf("%s %s\n", m.Flags(), extra)
+		case "jsonl":
+			err = m.Write(os.Stdout)
+		default:
+			fmt.Println(weatherString(c))
+		}
+		if err != nil {
+			exit(err)
+		}
+		return
 	}
 
-	w := NewWeatherClient(key, cache, qps, loc, offline)
-	if s.ID != 0 {
-		c, err := HistoricalConditions(w, s.AverageLocation, t, loc)
+	if ranked {
+		t := time.Now()
+		if tf.Time != nil {
+			t = *tf.Time
+		}
+
+		climbs, err := GetClimbs(climbsFile)
 		if err != nil {
 			exit(err)
 		}
+		var segments []*Segment
+		if query != "" {
+			q, err := ParseQuery(query)
+			if err != nil {
+				exit(err)
+			}
+			for _, m := range Catalog(climbs).Query(q) {
+				s := m.Climb.Segment
+				segments = append(segments, &s)
+			}
+		} else {
+			for i := range climbs {
+				segments = append(segments, &climbs[i].Segment)
+			}
+		}
 
-		var past *weather.Conditions
+		historical := rank == "historical"
+		hist = hist || historical
+
+		var avgs HistoricalClimbAverages
 		if hist {
-			avgs, err := GetHistoricalAverages()
+			avgs, err = GetHistoricalAverages()
 			if err != nil {
 				exit(err)
 			}
-			past = avgs.Get(&s, t, loc)
 		}
 
-		baseline, historical, err := WNF(&s, c, past)
+		windows, err := w.ScoreSegments(segments, t, avgs, historical, parallel, loc)
 		if err != nil {
 			exit(err)
 		}
+		SortWindows(windows, historical)
 
-		fi, _ := os.Stdout.Stat()
-		if (fi.Mode() & os.ModeCharDevice) != 0 {
+		if format == "text" {
+			fmt.Println(t.In(loc).Format("Mon Jan _2 3:04PM 2006"))
+		}
+		err = outputWindows(windows, format, hist, false, loc)
+		if err != nil {
+			exit(err)
+		}
+		return
+	}
+
+	if len(flag.Args()) > 0 {
+		climbs, err := GetClimbs(climbsFile)
+		if err != nil {
+			exit(err)
+		}
+		for _, arg := range flag.Args() {
+			m := NewMessage()
+			m.Segment, err = FindSegment(climbs, []string{arg}, token)
+			if err != nil {
+				exit(err)
+			}
+			msgs = append(msgs, m)
+		}
+	}
+
+	if len(msgs) == 0 {
+		exit(fmt.Errorf("latlng or segment required"))
+	}
+
+	hist = hist || (best && rank == "historical")
+
+	var avgs HistoricalClimbAverages
+	if hist {
+		avgs, err = GetHistoricalAverages()
+		if err != nil {
+			exit(err)
+		}
+	}
+
+	if best {
+		if min < 0 || max > 23 || min > max {
+			exit(fmt.Errorf("min and max must be in the range [0-23] with min <= max but got min=%d max=%d", min, max))
+		}
+		opts := WindowOptions{
+			Days:       days,
+			MinHour:    min,
+			MaxHour:    max,
+			Daylight:   daylight,
+			Historical: rank == "historical",
+		}
+		err = bestWindows(w, msgs, avgs, opts, n, format, loc)
+		if err != nil {
+			exit(err)
+		}
+		return
+	}
+
+	for i, m := range msgs {
+		if m.Segment == nil {
+			exit(fmt.Errorf("segment required"))
+		}
+		s := m.Segment
+
+		t := time.Now()
+		if tf.Time != nil {
+			t = *tf.Time
+		} else if m.Time != nil {
+			t = *m.Time
+		}
+
+		c, err := w.Conditions(s.AverageLocation, t)
+		if err != nil {
+			exit(err)
+		}
+
+		var past *weather.Conditions
+		if hist {
+			past = avgs.Get(s, t, loc)
+		}
+
+		baseline, historical, err := WNF(s, c, past)
+		if err != nil {
+			exit(err)
+		}
+
+		m.Time, m.Conditions, m.WNF, m.HistoricalWNF = &t, c, baseline, historical
+		switch format {
+		case "flags":
+			fmt.Println(m.Flags())
+		case "jsonl":
+			err = m.Write(os.Stdout)
+			if err != nil {
+				exit(err)
+			}
+		default:
+			if len(msgs) > 1 {
+				if i > 0 {
+					fmt.Println()
+				}
+				fmt.Println(s.Name)
+			}
 			h := ""
 			if hist && past != nil {
 				h = fmt.Sprintf("\n%s => %s\n", weatherString(past), displayScore(historical))
 			}
 			fmt.Printf("%s => %s\n%s", weatherString(c), displayScore(baseline), h)
-		} else {
-			fmt.Printf("-rho=%.4f -vw=%.3f -dw=%.2f -db=%.2f -d=%.2f -e=%.2f\n",
-				c.AirDensity, c.WindSpeed, c.WindBearing, s.AverageDirection, s.Distance, s.TotalElevationGain)
 		}
-	} else if ll != nil {
-		c, err := HistoricalConditions(w, *ll, t, loc)
-		if err != nil {
-			exit(err)
+	}
+}
+
+// bestWindows outputs the n best forecasted windows across all of the
+// segments of msgs.
+func bestWindows(w *Weather, msgs []*Message, avgs HistoricalClimbAverages, opts WindowOptions, n int, format string, loc *time.Location) error {
+	var windows []Window
+	for _, m := range msgs {
+		s := m.Segment
+		if s == nil {
+			return fmt.Errorf("segment required")
 		}
 
-		// Remove -h=... from the end of extra so that it doesn't conflict with rho
-		h := strings.LastIndex(extra, " ")
-		if h > 0 {
-			extra = extra[:h]
+		f, err := w.Forecast(s.AverageLocation)
+		if err != nil {
+			return err
 		}
-		// NOTE: must specify -db!
-		fmt.Printf("-rho=%.4f -vw=%.3f -dw=%2.f %s\n", c.AirDensity, c.WindSpeed, c.WindBearing, extra)
-	} else {
-		exit(fmt.Errorf("latlng or segment required"))
+		ws, err := Windows(s, f, avgs, opts, loc)
+		if err != nil {
+			return err
+		}
+		windows = append(windows, ws...)
 	}
-}
 
-func HistoricalConditions(w *Weather, ll geo.LatLng, t time.Time, loc *time.Location) (*weather.Conditions, error) {
-	f, err := w.Historical(ll, t)
-	if err != nil {
-		return nil, err
+	SortWindows(windows, opts.Historical)
+	if n > 0 && len(windows) > n {
+		windows = windows[:n]
 	}
-	if len(f.Hourly) != 24 {
-		return nil, fmt.Errorf("forecast is wrong size: want 24, got %d", len(f.Hourly))
+
+	return outputWindows(windows, format, avgs != nil, true, loc)
+}
+
+// outputWindows outputs the ranked windows in the format, with the time of
+// each and the historical scores if requested.
+func outputWindows(windows []Window, format string, hist, times bool, loc *time.Location) error {
+	switch format {
+	case "json":
+		j, err := json.MarshalIndent(windows, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(j))
+		return nil
+	case "jsonl", "flags":
+		for _, win := range windows {
+			m := NewMessage()
+			t := win.Time
+			m.Segment, m.Time, m.Conditions = win.Segment, &t, win.Conditions
+			m.WNF, m.HistoricalWNF = win.WNF, win.HistoricalWNF
+			if format == "flags" {
+				fmt.Println(m.Flags())
+				continue
+			}
+			err := m.Write(os.Stdout)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	t = t.In(loc)
-	hour, _, _ := t.Clock()
-	return f.Hourly[hour], nil
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "#\tCLIMB"
+	if times {
+		header += "\tTIME"
+	}
+	header += "\tWNF"
+	if hist {
+		header += "\tHISTORICAL"
+	}
+	fmt.Fprintln(tw, header+"\tTEMPERATURE\tWIND\tPRECIPITATION")
+	for i, win := range windows {
+		c := win.Conditions
+		row := fmt.Sprintf("%d\t%s", i+1, win.Segment.Name)
+		if times {
+			row += "\t" + win.Time.In(loc).Format("Mon Jan _2 3PM")
+		}
+		row += "\t" + displayScore(win.WNF)
+		if hist {
+			row += "\t" + displayScore(win.HistoricalWNF)
+		}
+		fmt.Fprintf(tw, "%s\t%.1f°C\t%s\t%.0f%%\n", row, c.Temperature, c.Wind(), c.PrecipProbability*100)
+	}
+	return tw.Flush()
 }
 
 func displayScore(s float64) string {
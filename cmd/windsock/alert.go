@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/scheibo/stravutils"
+)
+
+// ALERT_STATE_SUFFIX is appended to the output path to name the file recording
+// which alerts have already fired.
+const ALERT_STATE_SUFFIX = ".alerts.json"
+
+// ALERT_VERSION is the version of the webhook payload's schema, which follows
+// the same rules as the API_VERSION.
+const ALERT_VERSION = 1
+
+// ALERT_DAY_FORMAT identifies the day of a rule's window.
+const ALERT_DAY_FORMAT = "2006-01-02"
+
+// The channels alerts are delivered through, each of which is recorded as
+// having fired separately so that only those which fail are retried.
+const (
+	WEBHOOK_CHANNEL = "webhook"
+	EMAIL_CHANNEL   = "email"
+)
+
+// AlertConfig is the configuration file for alerts, eg:
+//
+//	{
+//	  "smtp": {"addr": "localhost:25", "from": "windsock@example.com"},
+//	  "rules": [{
+//	    "name": "OLH weekday mornings",
+//	    "climbs": ["OLH"],
+//	    "threshold": -4,
+//	    "days": ["weekdays"],
+//	    "min_hour": 7,
+//	    "max_hour": 9,
+//	    "within": "48h",
+//	    "webhook": "https://example.com/hooks/windsock",
+//	    "email": ["rider@example.com"]
+//	  }]
+//	}
+type AlertConfig struct {
+	SMTP  *SMTPConfig  `json:"smtp,omitempty"`
+	Rules []*AlertRule `json:"rules"`
+}
+
+// SMTPConfig is the server emails are sent through, authenticating with
+// PLAIN auth if a username is provided.
+type SMTPConfig struct {
+	Addr     string `json:"addr"`
+	From     string `json:"from"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// AlertRule fires when a climb's score is better than the threshold at an hour
+// within the rule's window. A rule fires at most once per climb and day, for
+// the best hour of its window on that day.
+type AlertRule struct {
+	Name string `json:"name"`
+	// Region is the slug of the region whose climbs the rule applies to, or
+	// every region if empty.
+	Region string `json:"region,omitempty"`
+	// Climbs are the names, aliases or slugs of the climbs the rule applies
+	// to, or every (non-hidden) climb if empty.
+	Climbs []string `json:"climbs,omitempty"`
+	// Threshold is the percentage the score must be better than, using the
+	// historical instead of the baseline score if Historical.
+	Threshold  float64 `json:"threshold"`
+	Historical bool    `json:"historical,omitempty"`
+	// Days are the names of the days of the week, "weekdays" or "weekends",
+	// or every day if empty.
+	Days []string `json:"days,omitempty"`
+	// MinHour and MaxHour [0-23] default to every hour of the region's forecasts
+	// if both are zero.
+	MinHour int `json:"min_hour,omitempty"`
+	MaxHour int `json:"max_hour,omitempty"`
+	// Within is the duration from the generation the rule looks ahead, or the
+	// entire forecast if empty.
+	Within string `json:"within,omitempty"`
+	// Webhook is a URL the Alert is POSTed to as JSON, and Email are the
+	// addresses it's sent to.
+	Webhook string   `json:"webhook,omitempty"`
+	Email   []string `json:"email,omitempty"`
+
+	days   map[time.Weekday]bool
+	within time.Duration
+}
+
+// Alert is a fired rule, and the payload of webhooks.
+type Alert struct {
+	Version int      `json:"version"`
+	Rule    string   `json:"rule"`
+	Region  string   `json:"region"`
+	Climb   APIClimb `json:"climb"`
+	// The rule's window on the day and the best conditions within it.
+	Start time.Time      `json:"start"`
+	End   time.Time      `json:"end"`
+	Best  *APIConditions `json:"best"`
+	Score float64        `json:"score"`
+	URL   string         `json:"url"`
+
+	rule *AlertRule
+	day  string
+}
+
+// key identifies the window an alert fired for through the channel. The day
+// is last so that keys for windows which have passed can be pruned.
+func (a *Alert) key(channel string) string {
+	return strings.Join([]string{a.Rule, a.Region, a.Climb.Slug, channel, a.day}, "|")
+}
+
+// channels returns the channels the alert is delivered through.
+func (a *Alert) channels() []string {
+	var channels []string
+	if a.rule.Webhook != "" {
+		channels = append(channels, WEBHOOK_CHANNEL)
+	}
+	if len(a.rule.Email) > 0 {
+		channels = append(channels, EMAIL_CHANNEL)
+	}
+	return channels
+}
+
+// GetAlertConfig reads and validates the alert configuration in file.
+func GetAlertConfig(file string) (*AlertConfig, error) {
+	f, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var config AlertConfig
+	err = json.Unmarshal(f, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, r := range config.Rules {
+		err = r.validate()
+		if err != nil {
+			return nil, err
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate alert rule %q", r.Name)
+		}
+		names[r.Name] = true
+		if len(r.Email) > 0 && (config.SMTP == nil || config.SMTP.Addr == "" || config.SMTP.From == "") {
+			return nil, fmt.Errorf("alert rule %q sends email but no SMTP server is configured", r.Name)
+		}
+	}
+	return &config, nil
+}
+
+func (r *AlertRule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("alert rule must have a name")
+	}
+	if r.Webhook == "" && len(r.Email) == 0 {
+		return fmt.Errorf("alert rule %q must have a webhook or email", r.Name)
+	}
+
+	if r.MinHour == 0 && r.MaxHour == 0 {
+		r.MaxHour = 23
+	}
+	if r.MinHour < 0 || r.MaxHour > 23 || r.MinHour > r.MaxHour {
+		return fmt.Errorf("alert rule %q: min and max must be in the range [0-23] with min <= max but got min=%d max=%d",
+			r.Name, r.MinHour, r.MaxHour)
+	}
+
+	if r.Within != "" {
+		d, err := time.ParseDuration(r.Within)
+		if err != nil {
+			return fmt.Errorf("alert rule %q: %s", r.Name, err)
+		}
+		r.within = d
+	}
+
+	r.days = make(map[time.Weekday]bool)
+	for _, d := range r.Days {
+		switch strings.ToLower(d) {
+		case "weekdays":
+			for wd := time.Monday; wd <= time.Friday; wd++ {
+				r.days[wd] = true
+			}
+		case "weekends":
+			r.days[time.Saturday], r.days[time.Sunday] = true, true
+		default:
+			wd, ok := weekday(d)
+			if !ok {
+				return fmt.Errorf("alert rule %q has an invalid day %q", r.Name, d)
+			}
+			r.days[wd] = true
+		}
+	}
+	return nil
+}
+
+func weekday(s string) (time.Weekday, bool) {
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		if strings.EqualFold(s, wd.String()) || strings.EqualFold(s, wd.String()[:3]) {
+			return wd, true
+		}
+	}
+	return 0, false
+}
+
+// applies returns whether the rule applies to the climb.
+func (r *AlertRule) applies(c *Climb, hidden bool) bool {
+	if len(r.Climbs) == 0 {
+		return !hidden
+	}
+	for _, name := range r.Climbs {
+		if strings.EqualFold(name, c.Name) || slugify(name) == slugify(c.Name) {
+			return true
+		}
+		for _, a := range c.Aliases {
+			if strings.EqualFold(name, a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches returns whether the conditions at the hour are within the rule's
+// window and better than its threshold.
+func (r *AlertRule) matches(c *ScoredConditions, now time.Time) bool {
+	t := c.LocalTime
+	if !t.After(now) || (r.within > 0 && t.After(now.Add(r.within))) {
+		return false
+	}
+	if len(r.days) > 0 && !r.days[t.Weekday()] {
+		return false
+	}
+	if t.Hour() < r.MinHour || t.Hour() > r.MaxHour {
+		return false
+	}
+	return (r.score(c)-1)*100 <= r.Threshold
+}
+
+func (r *AlertRule) score(c *ScoredConditions) float64 {
+	if r.Historical {
+		return c.historical
+	}
+	return c.baseline
+}
+
+// alerts returns the alerts the rule fires for the region's forecasts, the
+// best hour of each climb's window on each day.
+func (r *AlertRule) alerts(reg *region, forecasts []*ClimbForecast, now time.Time) []*Alert {
+	var alerts []*Alert
+	if r.Region != "" && r.Region != reg.Slug {
+		return alerts
+	}
+
+	for k, cf := range forecasts {
+		if cf.Unavailable() || !r.applies(cf.Climb, k >= reg.hidden) {
+			continue
+		}
+
+		best := make(map[string]*ScoredConditions)
+		var days []string
+		for _, df := range cf.Forecast.Days {
+			for _, c := range df.Conditions {
+				if c == nil || !r.matches(c, now) {
+					continue
+				}
+				day := c.LocalTime.Format(ALERT_DAY_FORMAT)
+				if b, ok := best[day]; !ok {
+					days = append(days, day)
+					best[day] = c
+				} else if r.score(c) < r.score(b) {
+					best[day] = c
+				}
+			}
+		}
+
+		for _, day := range days {
+			c := best[day]
+			y, m, d := c.LocalTime.Date()
+			loc := c.LocalTime.Location()
+			alerts = append(alerts, &Alert{
+				Version: ALERT_VERSION,
+				Rule:    r.Name,
+				Region:  reg.Slug,
+				Climb:   apiClimb(cf),
+				Start:   time.Date(y, m, d, r.MinHour, 0, 0, 0, loc),
+				End:     time.Date(y, m, d, r.MaxHour+1, 0, 0, 0, loc),
+				Best:    apiConditions(c),
+				Score:   (r.score(c) - 1) * 100,
+				URL:     strings.TrimSuffix(reg.AbsoluteURL, "/") + "/" + cf.Slug() + "/",
+				rule:    r,
+				day:     day,
+			})
+		}
+	}
+	return alerts
+}
+
+// alerter fires the alerts of each generation, recording those which have
+// fired in its state file so that each only fires once.
+type alerter struct {
+	config *AlertConfig
+	state  string
+	client *http.Client
+}
+
+func newAlerter(config *AlertConfig, state string) *alerter {
+	return &alerter{config: config, state: state, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// fire sends the alerts which haven't already fired for the forecasts of each
+// region, or if dryRun just prints them. Each channel of an alert is recorded
+// once it sends, so channels which fail are retried after the next generation
+// without repeating those which succeeded.
+func (a *alerter) fire(now time.Time, regions []*region, forecasts [][]*ClimbForecast, dryRun bool) error {
+	fired, err := a.load()
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, rule := range a.config.Rules {
+		for i, reg := range regions {
+			for _, alert := range rule.alerts(reg, forecasts[i], now) {
+				var pending []string
+				for _, channel := range alert.channels() {
+					if _, ok := fired[alert.key(channel)]; !ok {
+						pending = append(pending, channel)
+					}
+				}
+				if len(pending) == 0 {
+					continue
+				}
+				if dryRun {
+					fmt.Printf("! %s (%s)\n", alert.Subject(), strings.Join(pending, ", "))
+					continue
+				}
+
+				for _, channel := range pending {
+					key := alert.key(channel)
+					err := a.send(alert, channel)
+					if err != nil {
+						errs = append(errs, fmt.Sprintf("%s: %s", key, err))
+						continue
+					}
+					fired[key] = now
+				}
+			}
+		}
+	}
+	if dryRun {
+		return nil
+	}
+
+	// Forget alerts for windows which have passed.
+	cutoff := now.AddDate(0, 0, -2).Format(ALERT_DAY_FORMAT)
+	for key := range fired {
+		if day := key[strings.LastIndex(key, "|")+1:]; day < cutoff {
+			delete(fired, key)
+		}
+	}
+	err = a.save(fired)
+	if err != nil {
+		return err
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%d alert deliveries failed:\n  %s", len(errs), strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// load returns the time each alert fired through each channel, keyed by
+// Alert.key.
+func (a *alerter) load() (map[string]time.Time, error) {
+	fired := make(map[string]time.Time)
+	j, err := ioutil.ReadFile(a.state)
+	if os.IsNotExist(err) {
+		return fired, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return fired, json.Unmarshal(j, &fired)
+}
+
+func (a *alerter) save(fired map[string]time.Time) error {
+	j, err := json.MarshalIndent(fired, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(a.state, append(j, '\n'))
+}
+
+func (a *alerter) send(alert *Alert, channel string) error {
+	switch channel {
+	case WEBHOOK_CHANNEL:
+		return a.post(alert.rule.Webhook, alert)
+	case EMAIL_CHANNEL:
+		return a.email(alert.rule.Email, alert)
+	default:
+		return fmt.Errorf("unknown alert channel %q", channel)
+	}
+}
+
+// post POSTs the alert as JSON to url, which must respond with a 2xx status.
+func (a *alerter) post(url string, alert *Alert) error {
+	j, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.Post(url, "application/json", bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s responded with %s", url, resp.Status)
+	}
+	return nil
+}
+
+// email sends the alert as a plain text email to each address.
+func (a *alerter) email(to []string, alert *Alert) error {
+	s := a.config.SMTP
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", alert.Subject())
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(alert.Body(), "\n", "\r\n", -1))
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := s.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, to, msg.Bytes())
+}
+
+// Subject summarizes the alert.
+func (a *Alert) Subject() string {
+	return fmt.Sprintf("%s: %s on %s", a.Climb.Name, displayScore(a.Score/100+1), dayTime(a.Best.Time))
+}
+
+// Body describes the alert in plain text.
+func (a *Alert) Body() string {
+	return fmt.Sprintf("%s is %s at %s (%s), better than %.1f%% for %q between %s and %s.\n\n%s\n\n%s\n",
+		a.Climb.Name, displayScore(a.Score/100+1), fullTime(a.Best.Time), scoreName(a.rule.Historical),
+		a.rule.Threshold, a.Rule, a.Start.Format("3PM"), a.End.Format("3PM"),
+		weatherString(a.Best.Conditions), a.URL)
+}
+
+func scoreName(historical bool) string {
+	if historical {
+		return "historical"
+	}
+	return "baseline"
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/scheibo/stravutils"
+	"github.com/scheibo/weather"
+)
+
+var LA, _ = time.LoadLocation("America/Los_Angeles")
+
+// NOW is a Monday morning.
+var NOW = time.Date(2026, 10, 19, 6, 30, 0, 0, LA)
+
+func conditionsAt(t time.Time, score float64) *ScoredConditions {
+	return &ScoredConditions{
+		Conditions: &weather.Conditions{Time: t, AirDensity: 1.2, WindSpeed: 3, WindBearing: 180},
+		LocalTime:  t,
+		baseline:   score,
+		historical: score,
+	}
+}
+
+// forecastFor returns a forecast for the climb over the days following NOW
+// with scores from the given function of each hour.
+func forecastFor(c *Climb, days int, score func(t time.Time) float64) *ClimbForecast {
+	f := &ScoredForecast{Current: conditionsAt(NOW, 1)}
+	for d := 0; d < days; d++ {
+		y, m, day := NOW.AddDate(0, 0, d).Date()
+		df := &DayForecast{Day: fmt.Sprintf("%d", day)}
+		for h := 6; h <= 18; h++ {
+			t := time.Date(y, m, day, h, 0, 0, 0, LA)
+			df.Conditions = append(df.Conditions, conditionsAt(t, score(t)))
+		}
+		f.Days = append(f.Days, df)
+	}
+	return &ClimbForecast{Climb: c, Forecast: f}
+}
+
+func testRegion(climbs ...Climb) *region {
+	return &region{
+		Region: Region{Name: "Bay Area", Slug: "bay-area", AbsoluteURL: "https://example.com/windsock"},
+		climbs: climbs,
+		hidden: len(climbs),
+		loc:    LA,
+	}
+}
+
+func testRule(t *testing.T, r *AlertRule) *AlertRule {
+	if r.Name == "" {
+		r.Name = "test"
+	}
+	if r.Webhook == "" && len(r.Email) == 0 {
+		r.Webhook = "http://localhost/"
+	}
+	err := r.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestAlertRuleMatches(t *testing.T) {
+	at := func(day, hour int) time.Time {
+		return time.Date(2026, 10, day, hour, 0, 0, 0, LA)
+	}
+
+	tests := []struct {
+		name string
+		rule AlertRule
+		t    time.Time
+		// Score as a percentage.
+		score float64
+		want  bool
+	}{
+		{"better than threshold", AlertRule{Threshold: -3}, at(19, 8), -4, true},
+		{"at threshold", AlertRule{Threshold: -3}, at(19, 8), -3, true},
+		{"worse than threshold", AlertRule{Threshold: -3}, at(19, 8), -2, false},
+		{"in the past", AlertRule{Threshold: -3}, at(19, 6), -4, false},
+		{"weekday", AlertRule{Threshold: -3, Days: []string{"weekdays"}}, at(20, 8), -4, true},
+		{"not a weekday", AlertRule{Threshold: -3, Days: []string{"weekdays"}}, at(24, 8), -4, false},
+		{"weekend", AlertRule{Threshold: -3, Days: []string{"weekends"}}, at(25, 8), -4, true},
+		{"named day", AlertRule{Threshold: -3, Days: []string{"Tue", "thursday"}}, at(22, 8), -4, true},
+		{"not a named day", AlertRule{Threshold: -3, Days: []string{"Tue", "thursday"}}, at(21, 8), -4, false},
+		{"within hours", AlertRule{Threshold: -3, MinHour: 7, MaxHour: 9}, at(19, 9), -4, true},
+		{"before hours", AlertRule{Threshold: -3, MinHour: 7, MaxHour: 9}, at(20, 6), -4, false},
+		{"after hours", AlertRule{Threshold: -3, MinHour: 7, MaxHour: 9}, at(19, 10), -4, false},
+		{"within", AlertRule{Threshold: -3, Within: "48h"}, at(21, 6), -4, true},
+		{"beyond within", AlertRule{Threshold: -3, Within: "48h"}, at(21, 7), -4, false},
+	}
+	for _, tt := range tests {
+		r := testRule(t, &tt.rule)
+		c := conditionsAt(tt.t, 1+tt.score/100)
+		if got := r.matches(c, NOW); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAlertRuleAlerts(t *testing.T) {
+	olh := Climb{Name: "Old La Honda", Aliases: []string{"OLH"}}
+	kings := Climb{Name: "Kings Mountain"}
+	reg := testRegion(olh, kings)
+
+	// Every morning is favorable, most of all at 8AM.
+	score := func(t time.Time) float64 {
+		switch t.Hour() {
+		case 7, 9:
+			return 0.96
+		case 8:
+			return 0.94
+		default:
+			return 1.02
+		}
+	}
+	forecasts := []*ClimbForecast{forecastFor(&reg.climbs[0], 3, score), forecastFor(&reg.climbs[1], 3, score)}
+
+	r := testRule(t, &AlertRule{Climbs: []string{"OLH"}, Threshold: -3})
+	alerts := r.alerts(reg, forecasts, NOW)
+	if len(alerts) != 3 {
+		t.Fatalf("got %d alerts, want one for each day", len(alerts))
+	}
+	for _, a := range alerts {
+		if a.Climb.Name != olh.Name {
+			t.Errorf("got an alert for %s, want only %s", a.Climb.Name, olh.Name)
+		}
+		if a.Best.Time.Hour() != 8 {
+			t.Errorf("got an alert for %s, want the best hour", a.Best.Time)
+		}
+		if a.URL != "https://example.com/windsock/old-la-honda/" {
+			t.Errorf("got url %s", a.URL)
+		}
+	}
+
+	r = testRule(t, &AlertRule{Region: "elsewhere", Threshold: -3})
+	if alerts := r.alerts(reg, forecasts, NOW); len(alerts) != 0 {
+		t.Errorf("got %d alerts for another region, want none", len(alerts))
+	}
+}
+
+// smtpServer is a minimal SMTP server which records the messages it receives,
+// rejecting them while fail is set.
+type smtpServer struct {
+	l        net.Listener
+	mu       sync.Mutex
+	fail     bool
+	messages []string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{l: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	fmt.Fprint(c, "220 localhost\r\n")
+
+	var data strings.Builder
+	reading := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if reading {
+			if line != ".\r\n" {
+				data.WriteString(line)
+				continue
+			}
+			reading = false
+			s.mu.Lock()
+			if s.fail {
+				fmt.Fprint(c, "554 rejected\r\n")
+			} else {
+				s.messages = append(s.messages, data.String())
+				fmt.Fprint(c, "250 ok\r\n")
+			}
+			s.mu.Unlock()
+			data.Reset()
+			continue
+		}
+
+		switch cmd := strings.ToUpper(line); {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			fmt.Fprint(c, "250 localhost\r\n")
+		case strings.HasPrefix(cmd, "DATA"):
+			reading = true
+			fmt.Fprint(c, "354 go ahead\r\n")
+		case strings.HasPrefix(cmd, "QUIT"):
+			fmt.Fprint(c, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(c, "250 ok\r\n")
+		}
+	}
+}
+
+func (s *smtpServer) received() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages)
+}
+
+func (s *smtpServer) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+// webhookServer counts the alerts POSTed to it.
+type webhookServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	alerts []Alert
+}
+
+func newWebhookServer() *webhookServer {
+	w := &webhookServer{}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var a Alert
+		err := json.NewDecoder(r.Body).Decode(&a)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.mu.Lock()
+		w.alerts = append(w.alerts, a)
+		w.mu.Unlock()
+	}))
+	return w
+}
+
+func (w *webhookServer) received() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.alerts)
+}
+
+// testAlerter returns an alerter with a single rule for the next morning
+// sending to both a webhook and email, along with the region and forecasts
+// which fire it once.
+func testAlerter(t *testing.T, webhook string, smtp *smtpServer) (*alerter, *region, [][]*ClimbForecast) {
+	dir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	config := fmt.Sprintf(`{
+		"smtp": {"addr": %q, "from": "windsock@example.com"},
+		"rules": [{
+			"name": "mornings",
+			"threshold": -3,
+			"min_hour": 7,
+			"max_hour": 9,
+			"within": "24h",
+			"webhook": %q,
+			"email": ["rider@example.com"]
+		}]
+	}`, smtp.l.Addr().String(), webhook)
+	file := filepath.Join(dir, "alerts.json")
+	err = ioutil.WriteFile(file, []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := GetAlertConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := testRegion(Climb{Name: "Old La Honda"})
+	f := forecastFor(&reg.climbs[0], 2, func(t time.Time) float64 { return 0.95 })
+	return newAlerter(c, filepath.Join(dir, "site"+ALERT_STATE_SUFFIX)), reg, [][]*ClimbForecast{{f}}
+}
+
+func TestAlerterFiresOncePerWindow(t *testing.T) {
+	webhook := newWebhookServer()
+	defer webhook.Close()
+	smtp := newSMTPServer(t)
+	defer smtp.l.Close()
+
+	a, reg, forecasts := testAlerter(t, webhook.URL, smtp)
+
+	err := a.fire(NOW, []*region{reg}, forecasts, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if webhook.received() != 0 || smtp.received() != 0 {
+		t.Fatalf("got alerts sent during a dry run")
+	}
+
+	for i := 0; i < 2; i++ {
+		// The next generation is still before the following morning.
+		err = a.fire(NOW.Add(time.Duration(i)*15*time.Minute), []*region{reg}, forecasts, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if webhook.received() != 1 || smtp.received() != 1 {
+			t.Fatalf("fire %d: got %d webhooks and %d emails, want 1 of each",
+				i+1, webhook.received(), smtp.received())
+		}
+	}
+
+	got := webhook.alerts[0]
+	if got.Version != ALERT_VERSION || got.Rule != "mornings" || got.Region != "bay-area" || got.Climb.Slug != "old-la-honda" {
+		t.Errorf("got unexpected alert %+v", got)
+	}
+	if !strings.Contains(smtp.messages[0], "Subject: Old La Honda: -5.00%") {
+		t.Errorf("got unexpected email:\n%s", smtp.messages[0])
+	}
+}
+
+func TestAlerterRetriesFailedChannels(t *testing.T) {
+	webhook := newWebhookServer()
+	defer webhook.Close()
+	smtp := newSMTPServer(t)
+	defer smtp.l.Close()
+
+	a, reg, forecasts := testAlerter(t, webhook.URL, smtp)
+
+	smtp.setFail(true)
+	err := a.fire(NOW, []*region{reg}, forecasts, false)
+	if err == nil {
+		t.Fatal("got no error when the email failed to send")
+	}
+	if webhook.received() != 1 || smtp.received() != 0 {
+		t.Fatalf("got %d webhooks and %d emails, want only the webhook", webhook.received(), smtp.received())
+	}
+
+	// Only the email is retried.
+	smtp.setFail(false)
+	err = a.fire(NOW, []*region{reg}, forecasts, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if webhook.received() != 1 || smtp.received() != 1 {
+		t.Fatalf("got %d webhooks and %d emails after retrying, want 1 of each", webhook.received(), smtp.received())
+	}
+}
+
+func TestAlerterPrunesState(t *testing.T) {
+	webhook := newWebhookServer()
+	defer webhook.Close()
+	smtp := newSMTPServer(t)
+	defer smtp.l.Close()
+
+	a, reg, forecasts := testAlerter(t, webhook.URL, smtp)
+
+	old := strings.Join([]string{"mornings", "bay-area", "old-la-honda", WEBHOOK_CHANNEL, "2026-10-16"}, "|")
+	recent := strings.Join([]string{"mornings", "bay-area", "old-la-honda", WEBHOOK_CHANNEL, "2026-10-17"}, "|")
+	err := a.save(map[string]time.Time{old: NOW.AddDate(0, 0, -3), recent: NOW.AddDate(0, 0, -2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.fire(NOW, []*region{reg}, forecasts, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fired, err := a.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fired[old]; ok {
+		t.Errorf("got %s, want it pruned", old)
+	}
+	if _, ok := fired[recent]; !ok {
+		t.Errorf("got %s pruned, want it kept", recent)
+	}
+	for _, channel := range []string{WEBHOOK_CHANNEL, EMAIL_CHANNEL} {
+		key := strings.Join([]string{"mornings", "bay-area", "old-la-honda", channel, "2026-10-19"}, "|")
+		if _, ok := fired[key]; !ok {
+			t.Errorf("got no record of %s", key)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	"github.com/scheibo/weather"
+)
+
+// The JSON API mirrors the HTML pages of the site, each index.json living
+// alongside the index.html of the page it describes:
+//
+//   /index.json             RootAPI: every climb's current and best conditions
+//   /{climb}/index.json     ClimbAPI: a climb's scored forecast grid by day
+//   /{day-time}/index.json  DayTimeAPI: every climb's conditions at a time
+//   /current/index.json     DayTimeAPI: every climb's current conditions
+//
+// When several regions are generated, each region's documents are nested under
+// the region's slug and /index.json is instead the RegionsAPI.
+//
+// Every document includes the API_VERSION of its schema, which is incremented
+// whenever a field is removed or its meaning changes. Fields may be added
+// without changing the version. Times are RFC 3339 in the site's time zone.
+
+// API_VERSION is the version of the JSON API's schema.
+const API_VERSION = 1
+
+// API_FILE is the name of the JSON document for each page.
+const API_FILE = "index.json"
+
+// APIHeader is included in every JSON document.
+type APIHeader struct {
+	Version   int       `json:"version"`
+	Generated time.Time `json:"generated"`
+}
+
+// APIClimb identifies a climb. Slug is the path of the climb's pages.
+type APIClimb struct {
+	Name      string  `json:"name"`
+	Slug      string  `json:"slug"`
+	SegmentID int64   `json:"segment_id"`
+	Direction string  `json:"direction"`
+	Bearing   float64 `json:"bearing"`
+}
+
+// APIConditions are the conditions for a climb at a time and their scores.
+// Scores are wind normalization factors, where < 1 is favorable, relative to
+// still air (baseline) and to the historical average conditions (historical).
+// Ranks bucket the scores from -5 (worst) to 5 (best).
+type APIConditions struct {
+	Time           time.Time           `json:"time"`
+	Baseline       float64             `json:"baseline"`
+	Historical     float64             `json:"historical"`
+	BaselineRank   int                 `json:"baseline_rank"`
+	HistoricalRank int                 `json:"historical_rank"`
+	Conditions     *weather.Conditions `json:"conditions"`
+}
+
+// APIBest are the best conditions forecasted for a climb by each score.
+type APIBest struct {
+	Baseline   *APIConditions `json:"baseline"`
+	Historical *APIConditions `json:"historical"`
+}
+
+// RootAPI is the ranking of every climb.
+type RootAPI struct {
+	APIHeader
+	Climbs []*RootAPIClimb `json:"climbs"`
+}
+
+// RootAPIClimb is a climb's current and best conditions. Unavailable climbs
+// have no conditions.
+type RootAPIClimb struct {
+	APIClimb
+	Unavailable bool           `json:"unavailable,omitempty"`
+	Current     *APIConditions `json:"current,omitempty"`
+	Best        *APIBest       `json:"best,omitempty"`
+}
+
+// RegionsAPI lists the regions of the site.
+type RegionsAPI struct {
+	APIHeader
+	Regions []*APIRegion `json:"regions"`
+}
+
+// APIRegion identifies a region. URL is the root of the region's site.
+type APIRegion struct {
+	Name   string `json:"name"`
+	Slug   string `json:"slug"`
+	URL    string `json:"url"`
+	Climbs int    `json:"climbs"`
+}
+
+// ClimbAPI is a climb's scored forecast. Each day has the same number of
+// hours, with null for any hours outside of the forecast.
+type ClimbAPI struct {
+	APIHeader
+	Climb       APIClimb       `json:"climb"`
+	Unavailable bool           `json:"unavailable,omitempty"`
+	Current     *APIConditions `json:"current,omitempty"`
+	Best        *APIBest       `json:"best,omitempty"`
+	Days        []*APIDay      `json:"days,omitempty"`
+}
+
+// APIDay is the forecast for a day.
+type APIDay struct {
+	Day   string           `json:"day"`
+	Hours []*APIConditions `json:"hours"`
+}
+
+// DayTimeAPI is every climb's conditions at a time, along with the historical
+// average conditions at the time.
+type DayTimeAPI struct {
+	APIHeader
+	Time       time.Time           `json:"time"`
+	Historical *weather.Conditions `json:"historical,omitempty"`
+	Climbs     []*DayTimeAPIClimb  `json:"climbs"`
+}
+
+// DayTimeAPIClimb is a climb's conditions at a time.
+type DayTimeAPIClimb struct {
+	APIClimb
+	Conditions *APIConditions `json:"conditions"`
+}
+
+func (r *Renderer) apiHeader() APIHeader {
+	return APIHeader{Version: API_VERSION, Generated: r.now.In(r.loc)}
+}
+
+func apiClimb(cf *ClimbForecast) APIClimb {
+	return APIClimb{
+		Name:      cf.Climb.Name,
+		Slug:      cf.Slug(),
+		SegmentID: cf.Climb.Segment.ID,
+		Direction: cf.ClimbDirection(),
+		Bearing:   cf.Climb.Segment.AverageDirection,
+	}
+}
+
+func apiConditions(c *ScoredConditions) *APIConditions {
+	if c == nil {
+		return nil
+	}
+	return &APIConditions{
+		Time:           c.LocalTime,
+		Baseline:       c.baseline,
+		Historical:     c.historical,
+		BaselineRank:   rank(c.baseline),
+		HistoricalRank: rank(c.historical),
+		Conditions:     c.Conditions,
+	}
+}
+
+func apiBest(f *ScoredForecast) *APIBest {
+	return &APIBest{
+		Baseline:   apiConditions(f.Best(false)),
+		Historical: apiConditions(f.Best(true)),
+	}
+}
+
+func (r *Renderer) rootAPI() *RootAPI {
+	data := &RootAPI{APIHeader: r.apiHeader()}
+	for _, cf := range r.forecasts[:r.hidden] {
+		c := &RootAPIClimb{APIClimb: apiClimb(cf), Unavailable: cf.Unavailable()}
+		if !c.Unavailable {
+			c.Current = apiConditions(cf.Forecast.Current)
+			c.Best = apiBest(cf.Forecast)
+		}
+		data.Climbs = append(data.Climbs, c)
+	}
+	return data
+}
+
+func (r *Renderer) regionsAPI(regions []*RegionTmpl) *RegionsAPI {
+	data := &RegionsAPI{APIHeader: r.apiHeader()}
+	for _, rt := range regions {
+		data.Regions = append(data.Regions, &APIRegion{Name: rt.Name, Slug: rt.Slug, URL: rt.URL, Climbs: rt.Climbs})
+	}
+	return data
+}
+
+func (r *Renderer) climbAPI(cf *ClimbForecast) *ClimbAPI {
+	data := &ClimbAPI{APIHeader: r.apiHeader(), Climb: apiClimb(cf), Unavailable: cf.Unavailable()}
+	if data.Unavailable {
+		return data
+	}
+
+	data.Current = apiConditions(cf.Forecast.Current)
+	data.Best = apiBest(cf.Forecast)
+	for _, df := range cf.Forecast.Days {
+		d := &APIDay{Day: df.Day}
+		for _, c := range df.Conditions {
+			d.Hours = append(d.Hours, apiConditions(c))
+		}
+		data.Days = append(data.Days, d)
+	}
+	return data
+}
+
+func (r *Renderer) dayTimeAPI(d *DayTimeTmpl) *DayTimeAPI {
+	data := &DayTimeAPI{APIHeader: r.apiHeader(), Time: d.LocalTime, Historical: d.historical}
+	for _, cc := range d.Conditions {
+		cf := &ClimbForecast{Climb: cc.Climb}
+		data.Climbs = append(data.Climbs, &DayTimeAPIClimb{APIClimb: apiClimb(cf), Conditions: apiConditions(cc.Conditions)})
+	}
+	return data
+}
+
+// writeAPI writes v as the JSON document of the page in dir.
+func writeAPI(v interface{}, dir string) error {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f, err := create(filepath.Join(dir, API_FILE))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(j, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FEED_FILE is the name of the Atom feed of notable conditions.
+const FEED_FILE = "feed.xml"
+
+// FEED_ENTRIES is the maximum number of entries kept in the feed.
+const FEED_ENTRIES = 50
+
+// FEED_TAG_DATE is the date used in the feed's tag URIs (RFC 4151). It must
+// never change, otherwise every entry would appear new to feed readers.
+const FEED_TAG_DATE = "2018"
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID      string   `xml:"id"`
+	Title   string   `xml:"title"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary"`
+}
+
+// renderFeed writes the Atom feed, adding an entry for each climb whose best
+// upcoming conditions are better than the threshold or better than the best
+// in the previous generation of the site. Entries are identified by the climb
+// and the hour of the conditions, so an entry is only posted once however
+// many generations the conditions remain notable for.
+func (r *Renderer) renderFeed() error {
+	root := strings.TrimSuffix(r.absoluteURL, "/")
+	host := "windsock"
+	if u, err := url.Parse(r.absoluteURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	prev, err := r.previousFeed()
+	if err != nil {
+		return err
+	}
+	bests, err := r.previousBests()
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, e := range prev.Entries {
+		seen[e.ID] = true
+	}
+
+	updated := r.now.UTC().Format(time.RFC3339)
+	var entries []atomEntry
+	for _, cf := range r.forecasts[:r.hidden] {
+		if cf.Unavailable() {
+			continue
+		}
+		best := cf.Forecast.Best(r.historical)
+		if best == nil {
+			continue
+		}
+
+		var reasons []string
+		score := r.score(best)
+		if (score-1)*100 <= r.threshold {
+			reasons = append(reasons, fmt.Sprintf("better than %.1f%%", r.threshold))
+		}
+		if b, ok := bests[cf.Slug()]; ok && b != nil && score < r.previousScore(b) {
+			reasons = append(reasons, fmt.Sprintf("new best (was %s)", displayScore(r.previousScore(b))))
+		}
+		if len(reasons) == 0 {
+			continue
+		}
+
+		id := fmt.Sprintf("tag:%s,%s:%s/%d", host, FEED_TAG_DATE, cf.Slug(), best.LocalTime.Unix())
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		entries = append(entries, atomEntry{
+			ID:      id,
+			Title:   fmt.Sprintf("%s: %s on %s", cf.Climb.Name, displayScore(score), best.DayTime()),
+			Updated: updated,
+			Link:    atomLink{Href: root + "/" + cf.Slug() + "/"},
+			Summary: fmt.Sprintf("%s %s: %s\n%s",
+				best.FullTime(), strings.Join(reasons, ", "), best.Score(r.historical), best.Weather()),
+		})
+	}
+
+	// Newest entries first, keeping only the most recent.
+	entries = append(entries, prev.Entries...)
+	if len(entries) > FEED_ENTRIES {
+		entries = entries[:FEED_ENTRIES]
+	}
+
+	feed := atomFeed{
+		ID:    fmt.Sprintf("tag:%s,%s:%s", host, FEED_TAG_DATE, FEED_FILE),
+		Title: r.title(),
+		Links: []atomLink{
+			{Href: root + "/" + FEED_FILE, Rel: "self"},
+			{Href: root + "/", Rel: "alternate"},
+		},
+		Author:  atomAuthor{Name: "Windsock"},
+		Entries: entries,
+	}
+	// The feed is only updated when it has new entries.
+	feed.Updated = updated
+	if len(entries) > 0 {
+		feed.Updated = entries[0].Updated
+	}
+
+	x, err := xml.MarshalIndent(&feed, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := create(filepath.Join(r.dir, FEED_FILE))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append([]byte(xml.Header), append(x, '\n')...))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// previousFeed returns the feed of the previous generation, if any.
+func (r *Renderer) previousFeed() (*atomFeed, error) {
+	var feed atomFeed
+	if r.previous == "" {
+		return &feed, nil
+	}
+
+	x, err := ioutil.ReadFile(filepath.Join(r.previous, FEED_FILE))
+	if os.IsNotExist(err) {
+		return &feed, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &feed, xml.Unmarshal(x, &feed)
+}
+
+// previousBests returns the best conditions of each climb in the previous
+// generation, if any.
+func (r *Renderer) previousBests() (map[string]*APIBest, error) {
+	bests := make(map[string]*APIBest)
+	if r.previous == "" {
+		return bests, nil
+	}
+
+	j, err := ioutil.ReadFile(filepath.Join(r.previous, API_FILE))
+	if os.IsNotExist(err) {
+		return bests, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var root RootAPI
+	err = json.Unmarshal(j, &root)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range root.Climbs {
+		bests[c.Slug] = c.Best
+	}
+	return bests, nil
+}
+
+func (r *Renderer) previousScore(b *APIBest) float64 {
+	if r.historical {
+		if b.Historical != nil {
+			return b.Historical.Historical
+		}
+	} else if b.Baseline != nil {
+		return b.Baseline.Baseline
+	}
+	return 1
+}
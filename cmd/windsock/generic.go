@@ -33,6 +33,31 @@ func renderAllRoot(m *minify.M, t *template.Template, data *RootTmpl, historical
 	return index(dir, historical)
 }
 
+func renderAllRegions(m *minify.M, t *template.Template, data *RegionsTmpl, historical bool, dir string) error {
+	path := data.CanonicalPath
+	// Historical
+	data.CanonicalPath = path + "historical"
+	data.Historical = true
+
+	h := filepath.Join(dir, "historical", "index.html")
+	err := executeTemplateRegions(m, t, data, h)
+	if err != nil {
+		return err
+	}
+
+	// Baseline
+	data.CanonicalPath = path + "baseline"
+	data.Historical = false
+
+	b := filepath.Join(dir, "baseline", "index.html")
+	err = executeTemplateRegions(m, t, data, b)
+	if err != nil {
+		return err
+	}
+
+	return index(dir, historical)
+}
+
 func renderAllDayTime(m *minify.M, t *template.Template, data *DayTimeTmpl, historical bool, dir string) error {
 	path := data.CanonicalPath
 	// Historical
@@ -111,6 +136,29 @@ func executeTemplateRoot(m *minify.M, t *template.Template, data *RootTmpl, path
 	return f.Close()
 }
 
+func executeTemplateRegions(m *minify.M, t *template.Template, data *RegionsTmpl, path string) error {
+	f, err := create(path)
+	if err != nil {
+		return err
+	}
+
+	w := m.Writer("text/html", f)
+	err = t.ExecuteTemplate(w, TEMPLATE_LAYOUT, data)
+	if err != nil {
+		w.Close()
+		f.Close()
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
 func executeTemplateDayTime(m *minify.M, t *template.Template, data *DayTimeTmpl, path string) error {
 	f, err := create(path)
 	if err != nil {
@@ -199,7 +247,7 @@ func aliases(as []string, orig string, historical bool) error {
 			return err
 		}
 
-		err = os.Symlink(filepath.Join("..", base, "index.html"),
+		err = symlink(filepath.Join("..", base, "index.html"),
 			filepath.Join(path, "index.html"))
 		if err != nil {
 			return err
@@ -210,18 +258,27 @@ func aliases(as []string, orig string, historical bool) error {
 		if err != nil {
 			return err
 		}
-		err = os.Symlink(filepath.Join("..", "..", base, "historical", "index.html"),
+		err = symlink(filepath.Join("..", "..", base, "historical", "index.html"),
 			filepath.Join(h, "index.html"))
 		if err != nil {
 			return err
 		}
 
+		err = symlink(filepath.Join("..", base, API_FILE), filepath.Join(path, API_FILE))
+		if err != nil {
+			return err
+		}
+		err = symlink(filepath.Join("..", base, CALENDAR_FILE), filepath.Join(path, CALENDAR_FILE))
+		if err != nil {
+			return err
+		}
+
 		b := filepath.Join(path, "baseline")
 		err = os.MkdirAll(b, 0755)
 		if err != nil {
 			return err
 		}
-		err = os.Symlink(filepath.Join("..", "..", base, "baseline", "index.html"),
+		err = symlink(filepath.Join("..", "..", base, "baseline", "index.html"),
 			filepath.Join(b, "index.html"))
 		if err != nil {
 			return err
@@ -242,10 +299,20 @@ func genAliases(name string, aliases []string) []string {
 func index(dir string, historical bool) error {
 	i := filepath.Join(dir, "index.html")
 	if historical {
-		return os.Symlink("historical/index.html", i)
+		return symlink("historical/index.html", i)
 	} else {
-		return os.Symlink("baseline/index.html", i)
+		return symlink("baseline/index.html", i)
+	}
+}
+
+// symlink creates newname as a symlink to oldname, replacing any existing
+// symlink (eg. from aliases shared between climbs).
+func symlink(oldname, newname string) error {
+	err := os.Remove(newname)
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
+	return os.Symlink(oldname, newname)
 }
 
 func create(path string) (*os.File, error) {
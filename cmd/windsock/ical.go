@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CALENDAR_FILE is the name of the iCalendar feed for the region and each climb.
+const CALENDAR_FILE = "calendar.ics"
+
+// CALENDAR_EVENTS is the maximum number of events in each climb's feed, and
+// REGION_CALENDAR_EVENTS in the feed for the entire region.
+const CALENDAR_EVENTS = 5
+const REGION_CALENDAR_EVENTS = 10
+
+// ICAL_TIME_FORMAT is the iCalendar format for times in UTC.
+const ICAL_TIME_FORMAT = "20060102T150405Z"
+
+// calendarEvent is a top-scoring hour for a climb.
+type calendarEvent struct {
+	cf *ClimbForecast
+	c  *ScoredConditions
+}
+
+// renderCalendars writes the feeds of the best upcoming hours for each climb
+// and for all of the (non-hidden) climbs of the region.
+func (r *Renderer) renderCalendars() error {
+	var region []calendarEvent
+	for k, cf := range r.forecasts {
+		events := r.bestHours(cf)
+		if k < r.hidden {
+			region = append(region, events...)
+		}
+		if len(events) > CALENDAR_EVENTS {
+			events = events[:CALENDAR_EVENTS]
+		}
+
+		err := r.writeCalendar(r.title(cf.Climb.Name), events,
+			filepath.Join(r.dir, cf.Slug(), CALENDAR_FILE))
+		if err != nil {
+			return err
+		}
+	}
+
+	r.sortEvents(region)
+	if len(region) > REGION_CALENDAR_EVENTS {
+		region = region[:REGION_CALENDAR_EVENTS]
+	}
+	return r.writeCalendar(r.title(), region, filepath.Join(r.dir, CALENDAR_FILE))
+}
+
+// bestHours returns the climb's upcoming hours which are favorable according
+// to the default score, best first.
+func (r *Renderer) bestHours(cf *ClimbForecast) []calendarEvent {
+	var events []calendarEvent
+	if cf.Unavailable() {
+		return events
+	}
+
+	for _, df := range cf.Forecast.Days {
+		for _, c := range df.Conditions {
+			if c == nil || !c.LocalTime.After(r.now) || r.score(c) >= 1 {
+				continue
+			}
+			events = append(events, calendarEvent{cf, c})
+		}
+	}
+	r.sortEvents(events)
+	return events
+}
+
+func (r *Renderer) sortEvents(events []calendarEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return r.score(events[i].c) < r.score(events[j].c)
+	})
+}
+
+func (r *Renderer) score(c *ScoredConditions) float64 {
+	if r.historical {
+		return c.historical
+	}
+	return c.baseline
+}
+
+// writeCalendar writes the events as an iCalendar (RFC 5545) feed to path.
+func (r *Renderer) writeCalendar(name string, events []calendarEvent, path string) error {
+	host := "windsock"
+	if u, err := url.Parse(r.absoluteURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	var buf bytes.Buffer
+	line := func(s string) {
+		buf.WriteString(foldLine(s))
+		buf.WriteString("\r\n")
+	}
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//Windsock//Windsock//EN")
+	line("CALSCALE:GREGORIAN")
+	line("METHOD:PUBLISH")
+	line("X-WR-CALNAME:" + escapeText(name))
+	line("X-WR-TIMEZONE:" + r.loc.String())
+	line("REFRESH-INTERVAL;VALUE=DURATION:PT1H")
+	line("X-PUBLISHED-TTL:PT1H")
+	for _, e := range events {
+		c, climb := e.c, e.cf.Climb
+		start := c.LocalTime.UTC()
+		link := strings.TrimSuffix(r.absoluteURL, "/") + "/" + e.cf.Slug() + "/"
+
+		description := fmt.Sprintf("Baseline: %s\nHistorical: %s\n%s\n%s",
+			displayScore(c.baseline), displayScore(c.historical), c.Weather(), link)
+
+		line("BEGIN:VEVENT")
+		// The UID is stable across generations so that calendar apps update the
+		// event instead of duplicating it.
+		line(fmt.Sprintf("UID:%d-%d@%s", climb.Segment.ID, start.Unix(), host))
+		line("DTSTAMP:" + r.now.UTC().Format(ICAL_TIME_FORMAT))
+		line("DTSTART:" + start.Format(ICAL_TIME_FORMAT))
+		line("DTEND:" + start.Add(time.Hour).Format(ICAL_TIME_FORMAT))
+		line("SUMMARY:" + escapeText(fmt.Sprintf("%s (%s)", climb.Name, displayScore(r.score(c)))))
+		line("DESCRIPTION:" + escapeText(description))
+		line(fmt.Sprintf("GEO:%f;%f", climb.Segment.AverageLocation.Lat, climb.Segment.AverageLocation.Lng))
+		line("URL:" + link)
+		line("TRANSP:TRANSPARENT")
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+
+	f, err := create(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// escapeText escapes s for use as an iCalendar TEXT value.
+func escapeText(s string) string {
+	return strings.NewReplacer(
+		"\\", "\\\\",
+		";", "\\;",
+		",", "\\,",
+		"\r\n", "\\n",
+		"\n", "\\n",
+	).Replace(s)
+}
+
+// foldLine folds s into lines of at most 75 octets, continuing each with a
+// space, without splitting any UTF-8 sequences.
+func foldLine(s string) string {
+	const max = 75
+
+	var buf bytes.Buffer
+	n := 0
+	for _, c := range s {
+		l := len(string(c))
+		if n+l > max {
+			buf.WriteString("\r\n ")
+			n = 1
+		}
+		buf.WriteRune(c)
+		n += l
+	}
+	return buf.String()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"path/filepath"
+
+	"github.com/scheibo/geo"
+	. "github.com/scheibo/stravutils"
+	"github.com/scheibo/weather"
+)
+
+// MAP_DIR is the directory of each climb's maps, named by the day-time slug
+// of the conditions they show, or CURRENT_SLUG for the current conditions.
+const MAP_DIR = "map"
+
+// MAP_SECTIONS is the number of sections each climb is divided into for
+// determining the wind component along it.
+const MAP_SECTIONS = 40
+
+// The dimensions of the map and the elevation profile below it.
+const (
+	MAP_WIDTH      = 320
+	MAP_HEIGHT     = 320
+	PROFILE_HEIGHT = 80
+	MAP_PADDING    = 16
+)
+
+// MAP_WIND_STEP is the wind component in km/h which each color corresponds to.
+const MAP_WIND_STEP = 4.0
+
+// MAP_COLORS match the .color-5 to .color5 classes of the site, from a
+// headwind to a tailwind.
+var MAP_COLORS = []string{
+	"#a50026", "#d73027", "#f46d43", "#fdae61", "#fee08b",
+	"#ffffbf",
+	"#d9ef8b", "#a6d96a", "#66bd63", "#1a9850", "#006837",
+}
+
+// climbMap is a climb's track projected onto the map and its elevation
+// profile, which are the same for all conditions.
+type climbMap struct {
+	// The projected points of the track and the elevation profile.
+	points  [][2]float64
+	profile [][2]float64
+	// The bearing of each section between consecutive points.
+	bearings []float64
+	low      float64
+	high     float64
+}
+
+// renderMaps renders the maps of each climb under the current conditions and
+// for each hour of its forecast.
+func (r *Renderer) renderMaps() error {
+	for _, cf := range r.forecasts {
+		if cf.Unavailable() || cf.Climb.Segment.Map == "" {
+			continue
+		}
+
+		m, err := newClimbMap(&cf.Climb.Segment)
+		if err != nil {
+			return err
+		}
+
+		dir := filepath.Join(r.dir, cf.Slug(), MAP_DIR)
+		err = r.writeMap(m, cf, cf.Forecast.Current, filepath.Join(dir, CURRENT_SLUG+".svg"))
+		if err != nil {
+			return err
+		}
+		for _, df := range cf.Forecast.Days {
+			for _, c := range df.Conditions {
+				if c == nil {
+					continue
+				}
+				err = r.writeMap(m, cf, c, filepath.Join(dir, c.DayTimeSlug()+".svg"))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// newClimbMap resamples the segment's track into sections and projects them
+// north-up onto the map using an equirectangular projection about the track's
+// mean latitude.
+func newClimbMap(s *Segment) (*climbMap, error) {
+	lles, err := geo.DecodeZPolyline(s.Map)
+	if err != nil {
+		return nil, err
+	}
+	if len(lles) < 2 {
+		return nil, fmt.Errorf("segment %d has too few points", s.ID)
+	}
+
+	d := make([]float64, len(lles))
+	for i := 1; i < len(lles); i++ {
+		d[i] = d[i-1] + geo.Distance(lles[i-1].LatLng(), lles[i].LatLng())
+	}
+	total := d[len(d)-1]
+	if total <= 0 {
+		return nil, fmt.Errorf("segment %d has no distance", s.ID)
+	}
+	lles = Resample(lles, d, total/MAP_SECTIONS)
+
+	m := &climbMap{low: lles[0].Ele, high: lles[0].Ele}
+	lat := 0.0
+	for _, lle := range lles {
+		lat += lle.Lat
+		m.low = math.Min(m.low, lle.Ele)
+		m.high = math.Max(m.high, lle.Ele)
+	}
+	scale := math.Cos(lat / float64(len(lles)) * math.Pi / 180)
+
+	xs, ys := make([]float64, len(lles)), make([]float64, len(lles))
+	minX, maxX, minY, maxY := math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)
+	for i, lle := range lles {
+		xs[i], ys[i] = lle.Lng*scale, -lle.Lat
+		minX, maxX = math.Min(minX, xs[i]), math.Max(maxX, xs[i])
+		minY, maxY = math.Min(minY, ys[i]), math.Max(maxY, ys[i])
+	}
+
+	// Fit the track to the map, preserving its aspect ratio and centering it.
+	w, h := float64(MAP_WIDTH-2*MAP_PADDING), float64(MAP_HEIGHT-2*MAP_PADDING)
+	k := math.Min(w/math.Max(maxX-minX, 1e-9), h/math.Max(maxY-minY, 1e-9))
+	offX := MAP_PADDING + (w-(maxX-minX)*k)/2
+	offY := MAP_PADDING + (h-(maxY-minY)*k)/2
+	for i := range lles {
+		m.points = append(m.points, [2]float64{offX + (xs[i]-minX)*k, offY + (ys[i]-minY)*k})
+		if i > 0 {
+			m.bearings = append(m.bearings, geo.Bearing(lles[i-1].LatLng(), lles[i].LatLng()))
+		}
+	}
+
+	// The profile is drawn below the map, scaled to fill its height.
+	dist := 0.0
+	rise := math.Max(m.high-m.low, 1)
+	for i, lle := range lles {
+		if i > 0 {
+			dist += geo.Distance(lles[i-1].LatLng(), lle.LatLng())
+		}
+		x := MAP_PADDING + dist/total*float64(MAP_WIDTH-2*MAP_PADDING)
+		y := MAP_HEIGHT + PROFILE_HEIGHT - (lle.Ele-m.low)/rise*(PROFILE_HEIGHT-MAP_PADDING)
+		m.profile = append(m.profile, [2]float64{x, y})
+	}
+	return m, nil
+}
+
+// writeMap writes the map of the climb under the conditions to path.
+func (r *Renderer) writeMap(m *climbMap, cf *ClimbForecast, c *ScoredConditions, path string) error {
+	if c == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" font-family="sans-serif" font-size="11">`,
+		MAP_WIDTH, MAP_HEIGHT+PROFILE_HEIGHT, MAP_WIDTH, MAP_HEIGHT+PROFILE_HEIGHT)
+	fmt.Fprintf(&buf, "<title>%s: %s\n%s</title>", escapeXML(cf.Climb.Name), c.FullTime(), escapeXML(c.Weather()))
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/>`, MAP_WIDTH, MAP_HEIGHT+PROFILE_HEIGHT)
+
+	// Consecutive sections with the same color are drawn as a single line.
+	buf.WriteString(`<g fill="none" stroke-width="5" stroke-linecap="round" stroke-linejoin="round">`)
+	for i := 0; i < len(m.bearings); {
+		color := windColor(c.Conditions, m.bearings[i])
+		j := i + 1
+		for j < len(m.bearings) && windColor(c.Conditions, m.bearings[j]) == color {
+			j++
+		}
+		fmt.Fprintf(&buf, `<polyline stroke="%s" points="%s"/>`, color, svgPoints(m.points[i:j+1]))
+		i = j
+	}
+	buf.WriteString(`</g>`)
+
+	start, end := m.points[0], m.points[len(m.points)-1]
+	fmt.Fprintf(&buf, `<circle cx="%.1f" cy="%.1f" r="4" fill="#fff" stroke="#000"/>`, start[0], start[1])
+	fmt.Fprintf(&buf, `<circle cx="%.1f" cy="%.1f" r="4" fill="#000"/>`, end[0], end[1])
+
+	writeWindArrow(&buf, c.Conditions)
+
+	// The elevation profile is closed along its base to be filled.
+	first, last := m.profile[0], m.profile[len(m.profile)-1]
+	fmt.Fprintf(&buf, `<polygon fill="#ddd" stroke="#999" points="%.1f,%d %s %.1f,%d"/>`,
+		first[0], MAP_HEIGHT+PROFILE_HEIGHT, svgPoints(m.profile), last[0], MAP_HEIGHT+PROFILE_HEIGHT)
+	fmt.Fprintf(&buf, `<text x="%d" y="%d">%.0f m</text>`, MAP_PADDING, MAP_HEIGHT+MAP_PADDING-2, m.high)
+	fmt.Fprintf(&buf, `<text x="%d" y="%d" text-anchor="end">%.1f km</text>`,
+		MAP_WIDTH-MAP_PADDING, MAP_HEIGHT+MAP_PADDING-2, cf.Climb.Segment.Distance/1000)
+	buf.WriteString(`</svg>`)
+
+	f, err := create(path)
+	if err != nil {
+		return err
+	}
+	w := r.m.Writer("image/svg+xml", f)
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		w.Close()
+		f.Close()
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeWindArrow draws an arrow in the map's corner pointing the way the wind
+// is blowing, labelled with its speed.
+func writeWindArrow(buf *bytes.Buffer, c *weather.Conditions) {
+	const cx, cy = MAP_WIDTH - 2*MAP_PADDING, 2 * MAP_PADDING
+
+	fmt.Fprintf(buf, `<g transform="translate(%d,%d)">`, cx, cy)
+	fmt.Fprintf(buf, `<circle r="%d" fill="#fff" stroke="#999"/>`, MAP_PADDING)
+	if c.WindSpeed > 0 {
+		// The wind's bearing is the direction it's blowing from.
+		fmt.Fprintf(buf, `<path transform="rotate(%.1f)" d="M0,-12 L5,-2 L1.5,-2 L1.5,12 L-1.5,12 L-1.5,-2 L-5,-2 Z"/>`,
+			math.Mod(c.WindBearing+180, 360))
+	}
+	buf.WriteString(`</g>`)
+	fmt.Fprintf(buf, `<text x="%d" y="%d" text-anchor="middle">%.0f km/h</text>`,
+		cx, cy+MAP_PADDING+12, c.WindSpeed*msToKmh)
+}
+
+// windColor returns the color of the headwind or tailwind component of the
+// wind for a section with the given bearing.
+func windColor(c *weather.Conditions, bearing float64) string {
+	// Positive when the wind is blowing from the direction of travel.
+	headwind := c.WindSpeed * msToKmh * math.Cos((c.WindBearing-bearing)*math.Pi/180)
+	level := int(math.Max(-5, math.Min(5, math.Round(-headwind/MAP_WIND_STEP))))
+	return MAP_COLORS[level+5]
+}
+
+func svgPoints(pts [][2]float64) string {
+	var buf bytes.Buffer
+	for i, p := range pts {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(&buf, "%.1f,%.1f", p[0], p[1])
+	}
+	return buf.String()
+}
+
+func escapeXML(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	. "github.com/scheibo/stravutils"
+	"github.com/scheibo/weather"
+)
+
+// Region configures the site generated for an area's climbs. A configuration
+// file is a JSON array of regions, each of which is rendered into the
+// subdirectory named by its slug alongside an index of the regions.
+type Region struct {
+	Name string `json:"name"`
+	// Slug defaults to the slugified name.
+	Slug string `json:"slug,omitempty"`
+	// AbsoluteURL defaults to the region's subdirectory of the site's URL.
+	AbsoluteURL string `json:"absolute_url,omitempty"`
+	TimeZone    string `json:"timezone"`
+	// Climbs, Hidden and Historical are resources as accepted by GetClimbs and
+	// GetHistoricalAverages, defaulting to the Bay Area's.
+	Climbs     string `json:"climbs,omitempty"`
+	Hidden     string `json:"hidden,omitempty"`
+	Historical string `json:"historical,omitempty"`
+	// MinHour and MaxHour [0-23] default to 6 and 18 if both are zero.
+	MinHour int `json:"min_hour,omitempty"`
+	MaxHour int `json:"max_hour,omitempty"`
+}
+
+// GetRegions reads the regions configured in file, filling in their defaults
+// relative to the site's absoluteURL.
+func GetRegions(file, absoluteURL string) ([]Region, error) {
+	f, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var regions []Region
+	err = json.Unmarshal(f, &regions)
+	if err != nil {
+		return nil, err
+	}
+	if len(regions) == 0 {
+		return nil, fmt.Errorf("no regions configured in %s", file)
+	}
+
+	slugs := make(map[string]bool)
+	for i := range regions {
+		r := &regions[i]
+		if r.Slug == "" {
+			r.Slug = slugify(r.Name)
+		}
+		if r.AbsoluteURL == "" {
+			r.AbsoluteURL = strings.TrimSuffix(absoluteURL, "/") + "/" + r.Slug
+		}
+		if r.MinHour == 0 && r.MaxHour == 0 {
+			r.MinHour, r.MaxHour = minHour, maxHour
+		}
+
+		err = r.validate()
+		if err != nil {
+			return nil, err
+		}
+		if slugs[r.Slug] {
+			return nil, fmt.Errorf("duplicate region slug %q", r.Slug)
+		}
+		slugs[r.Slug] = true
+	}
+	return regions, nil
+}
+
+func (r *Region) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("region must have a name")
+	}
+	if r.Slug == "" || r.Slug != slugify(r.Slug) {
+		return fmt.Errorf("region %q has an invalid slug %q", r.Name, r.Slug)
+	}
+	if r.MinHour < 0 || r.MaxHour > 23 || r.MinHour >= r.MaxHour {
+		return fmt.Errorf("region %q: min and max must be in the range [0-23] with min < max but got min=%d max=%d",
+			r.Name, r.MinHour, r.MaxHour)
+	}
+	return nil
+}
+
+// region is a Region with its climbs loaded.
+type region struct {
+	Region
+	climbs []Climb
+	// The number of climbs which aren't hidden, which precede those which are.
+	hidden int
+	havgs  *HistoricalClimbAverages
+	loc    *time.Location
+	w      *weather.Client
+}
+
+// loadRegion loads the region's climbs and creates a client to fetch their
+// forecasts with. The historical averages are loaded separately by
+// loadAverages as they are only required to render the entire site.
+func loadRegion(cfg Region, key string) (*region, error) {
+	err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	loc, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	climbs, err := GetClimbs(cfg.Climbs)
+	if err != nil {
+		return nil, err
+	}
+
+	hidden := len(climbs)
+	if cfg.Hidden != "" {
+		hs, err := GetClimbs(cfg.Hidden)
+		if err != nil {
+			return nil, err
+		}
+		climbs = append(climbs, hs...)
+	}
+
+	return &region{
+		Region: cfg,
+		climbs: climbs,
+		hidden: hidden,
+		loc:    loc,
+		w:      weather.NewClient(weather.DarkSky(key), weather.TimeZone(loc)),
+	}, nil
+}
+
+func (r *region) loadAverages() error {
+	// NOTE: we expect all days to be present and will segfault if there are any are null.
+	havgs, err := GetHistoricalAverages(r.Historical)
+	if err != nil {
+		return err
+	}
+	r.havgs = &havgs
+	return nil
+}
+
+// has returns whether the segment is one of the region's climbs.
+func (r *region) has(segmentID int64) bool {
+	for _, c := range r.climbs {
+		if c.Segment.ID == segmentID {
+			return true
+		}
+	}
+	return false
+}
+
+// renderRegions renders the index of the regions into staging.
+func (g *generator) renderRegions(now time.Time, staging string, forecasts [][]*ClimbForecast) error {
+	var regions []*RegionTmpl
+	for i, r := range g.regions {
+		rt := &RegionTmpl{Name: r.Name, Slug: r.Slug, URL: strings.TrimSuffix(r.AbsoluteURL, "/"), Climbs: r.hidden}
+		for _, cf := range forecasts[i][:r.hidden] {
+			if cf.Unavailable() {
+				continue
+			}
+			if b := cf.Forecast.Best(true); b != nil &&
+				(rt.historical == nil || b.historical < rt.historical.Forecast.Best(true).historical) {
+				rt.historical = cf
+			}
+			if b := cf.Forecast.Best(false); b != nil &&
+				(rt.baseline == nil || b.baseline < rt.baseline.Forecast.Best(false).baseline) {
+				rt.baseline = cf
+			}
+		}
+		regions = append(regions, rt)
+	}
+
+	renderer := NewRenderer("", g.historical, g.absoluteURL, staging, nil, 0, nil, now, time.Local)
+	return renderer.renderRegions(g.templates, regions)
+}
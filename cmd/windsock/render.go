@@ -29,12 +29,14 @@ func getTemplates() map[string]*template.Template {
 	templates["root"] = template.Must(template.ParseFiles(layout, resource("root.tmpl.html")))
 	templates["time"] = template.Must(template.ParseFiles(layout, resource("time.tmpl.html"), script))
 	templates["climb"] = template.Must(template.ParseFiles(layout, resource("climb.tmpl.html"), script))
+	templates["regions"] = template.Must(template.ParseFiles(layout, resource("regions.tmpl.html")))
 	templates["404"] = template.Must(template.ParseFiles(resource(TEMPLATE_404)))
 	return templates
 }
 
 type Renderer struct {
 	m           *minify.M
+	region      string
 	historical  bool
 	absoluteURL string
 	dir         string
@@ -43,24 +45,27 @@ type Renderer struct {
 	havgs       *HistoricalClimbAverages
 	now         time.Time
 	loc         *time.Location
+	// The directory of the previous generation of the site, if any.
+	previous string
+	// Percentage which the best score of a climb must be better than to be
+	// included in the feed.
+	threshold float64
 }
 
-func NewRenderer(historical bool, absoluteURL, dir string, forecasts []*ClimbForecast, hidden int, havgs *HistoricalClimbAverages, now time.Time, loc *time.Location) *Renderer {
+func NewRenderer(region string, historical bool, absoluteURL, dir string, forecasts []*ClimbForecast, hidden int, havgs *HistoricalClimbAverages, now time.Time, loc *time.Location) *Renderer {
 	m := minify.New()
 	m.AddFunc("text/css", css.Minify)
 	m.AddFunc("text/html", html.Minify)
 	m.AddFunc("image/svg+xml", svg.Minify)
 	m.AddFuncRegexp(regexp.MustCompile("^(application|text)/(x-)?(java|ecma)script$"), js.Minify)
 
-	return &Renderer{m, historical, absoluteURL, dir, forecasts, hidden, havgs, now, loc}
+	return &Renderer{m: m, region: region, historical: historical, absoluteURL: absoluteURL, dir: dir,
+		forecasts: forecasts, hidden: hidden, havgs: havgs, now: now, loc: loc}
 }
 
+// render renders the entire site into r.dir, which is expected to be empty.
 func (r *Renderer) render(templates map[string]*template.Template) error {
-	err := os.RemoveAll(r.dir)
-	if err != nil {
-		return err
-	}
-	err = copyFile(resource("favicon.ico"), filepath.Join(r.dir, "favicon.ico"))
+	err := copyFile(resource("favicon.ico"), filepath.Join(r.dir, "favicon.ico"))
 	if err != nil {
 		return err
 	}
@@ -94,17 +99,67 @@ func (r *Renderer) render(templates map[string]*template.Template) error {
 	if err != nil {
 		return err
 	}
-	return nil
+
+	err = r.renderMaps()
+	if err != nil {
+		return err
+	}
+
+	err = r.renderCalendars()
+	if err != nil {
+		return err
+	}
+
+	return r.renderFeed()
+}
+
+// title returns the title of a page of the region's site.
+func (r *Renderer) title(parts ...string) string {
+	title := "Windsock"
+	if r.region != "" {
+		title += " - " + r.region
+	}
+	for _, p := range parts {
+		title += " - " + p
+	}
+	return title
 }
 
 func (r *Renderer) render404(t *template.Template) error {
-	data := LayoutTmpl{GenerationTime: r.now, AbsoluteURL: r.absoluteURL, Title: "Windsock - Bay Area - 404"}
+	data := LayoutTmpl{GenerationTime: r.now, AbsoluteURL: r.absoluteURL, Region: r.region, Title: r.title("404")}
 	return executeTemplate404(r.m, t, &data, filepath.Join(r.dir, "404.html"))
 }
 
 func (r *Renderer) renderRoot(t *template.Template) error {
-	data := RootTmpl{LayoutTmpl{GenerationTime: r.now, AbsoluteURL: r.absoluteURL, Title: "Windsock - Bay Area", Default: !r.historical}, r.forecasts[:r.hidden]}
-	return renderAllRoot(r.m, t, &data, r.historical, r.dir)
+	data := RootTmpl{LayoutTmpl{GenerationTime: r.now, AbsoluteURL: r.absoluteURL, Region: r.region, Title: r.title(), FeedTitle: r.title(), Default: !r.historical}, r.forecasts[:r.hidden]}
+	err := renderAllRoot(r.m, t, &data, r.historical, r.dir)
+	if err != nil {
+		return err
+	}
+	return writeAPI(r.rootAPI(), r.dir)
+}
+
+// renderRegions renders the index of the regions generated into r.dir, each of
+// which is rendered separately.
+func (r *Renderer) renderRegions(templates map[string]*template.Template, regions []*RegionTmpl) error {
+	err := copyFile(resource("favicon.ico"), filepath.Join(r.dir, "favicon.ico"))
+	if err != nil {
+		return err
+	}
+
+	tmpl, _ := templates["404"]
+	err = r.render404(tmpl)
+	if err != nil {
+		return err
+	}
+
+	tmpl, _ = templates["regions"]
+	data := RegionsTmpl{LayoutTmpl{GenerationTime: r.now, AbsoluteURL: r.absoluteURL, Title: r.title(), Default: !r.historical}, regions}
+	err = renderAllRegions(r.m, tmpl, &data, r.historical, r.dir)
+	if err != nil {
+		return err
+	}
+	return writeAPI(r.regionsAPI(regions), r.dir)
 }
 
 func (r *Renderer) renderDayTimes(t *template.Template) error {
@@ -112,6 +167,9 @@ func (r *Renderer) renderDayTimes(t *template.Template) error {
 
 	for i := 0; i < r.hidden; i++ {
 		cf := r.forecasts[i]
+		if cf.Unavailable() {
+			continue
+		}
 
 		path := filepath.Join(r.dir, CURRENT_SLUG)
 		current, ok := dayTimes[path]
@@ -158,6 +216,10 @@ func (r *Renderer) renderDayTimes(t *template.Template) error {
 		if err != nil {
 			return err
 		}
+		err = writeAPI(r.dayTimeAPI(data), dir)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -168,8 +230,10 @@ func (r *Renderer) dayTimeTmpl(c *ScoredConditions, slug string, segment *Segmen
 	data.GenerationTime = r.now
 	data.Default = !r.historical
 	data.AbsoluteURL = r.absoluteURL
+	data.Region = r.region
 	data.LocalTime = c.LocalTime
-	data.Title = "Windsock - Bay Area - " + data.DayTime()
+	data.Title = r.title(data.DayTime())
+	data.FeedTitle = r.title()
 	data.CanonicalPath = slug + "/"
 	data.historical = r.havgs.Get(segment, c.LocalTime, r.loc)
 	return data
@@ -213,14 +277,22 @@ func (r *Renderer) renderClimbs(t *template.Template) error {
 		return nil
 	}
 
+	// Every available forecast covers the same days.
 	var names, short []string
-	for _, df := range r.forecasts[0].Forecast.Days {
-		names = append(names, df.Day)
-		short = append(short, df.Day[:3])
+	for _, cf := range r.forecasts {
+		if cf.Unavailable() {
+			continue
+		}
+		for _, df := range cf.Forecast.Days {
+			names = append(names, df.Day)
+			short = append(short, df.Day[:3])
+		}
+		break
 	}
 
 	for k, cf := range r.forecasts {
 		data := r.climbTmpl(cf, names, short)
+		data.Map = !cf.Unavailable() && cf.Climb.Segment.Map != ""
 		if k < r.hidden {
 			data.Up = climbUp(r.forecasts, k)
 			data.Left = data.Up
@@ -228,7 +300,12 @@ func (r *Renderer) renderClimbs(t *template.Template) error {
 			data.Right = data.Down
 		}
 
-		err := renderAllClimb(r.m, t, &data, r.historical, filepath.Join(r.dir, data.Slug()))
+		dir := filepath.Join(r.dir, data.Slug())
+		err := renderAllClimb(r.m, t, &data, r.historical, dir)
+		if err != nil {
+			return err
+		}
+		err = writeAPI(r.climbAPI(cf), dir)
 		if err != nil {
 			return err
 		}
@@ -246,11 +323,18 @@ func (r *Renderer) climbTmpl(cf *ClimbForecast, names, short []string) ClimbTmpl
 	data.GenerationTime = r.now
 	data.Default = !r.historical
 	data.AbsoluteURL = r.absoluteURL
-	data.Title = "Windsock - Bay Area - " + cf.Climb.Name
+	data.Region = r.region
+	data.Title = r.title(cf.Climb.Name)
+	data.FeedTitle = r.title()
 	data.CanonicalPath = data.Slug() + "/"
 	data.Days = names
 	data.ShortDays = short
 
+	if cf.Unavailable() {
+		data.Unavailable = true
+		return data
+	}
+
 	hours := len(days[0].Conditions) // guaranteed to exist
 	data.Rows = make([]*ClimbTmplRow, hours)
 	for i := 0; i < hours; i++ {
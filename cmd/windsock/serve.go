@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HEALTH_PATH is the path of the health endpoint, which is independent of the
+// site's root.
+const HEALTH_PATH = "/healthz"
+
+// server serves the current generation of the site while regenerating it
+// every refresh interval. Each request resolves the current generation anew, so
+// the previous generation is served until the next one is published.
+type server struct {
+	g       *generator
+	root    string
+	refresh time.Duration
+
+	mu sync.Mutex
+	// The time of the last generation to be published, the time of the last
+	// attempt and the error it failed with, if any.
+	lastSuccess time.Time
+	lastAttempt time.Time
+	lastErr     error
+}
+
+// Health is the response of the health endpoint.
+type Health struct {
+	Status      string     `json:"status"`
+	Generation  string     `json:"generation,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+func newServer(g *generator, absoluteURL string, refresh time.Duration) *server {
+	root := "/"
+	if u, err := url.Parse(absoluteURL); err == nil && u.Path != "" {
+		root = strings.TrimSuffix(u.Path, "/") + "/"
+	}
+	return &server{g: g, root: root, refresh: refresh}
+}
+
+// listenAndServe serves the site on addr, regenerating it in the background.
+func (s *server) listenAndServe(addr string) error {
+	mime.AddExtensionType(".ics", "text/calendar; charset=utf-8")
+
+	// A generation left by a previous run is served until the first one is
+	// published.
+	cur, err := s.g.site.Current()
+	if err != nil {
+		return err
+	}
+	if cur != "" {
+		if t, err := time.ParseInLocation(GENERATION_FORMAT, cur, time.Local); err == nil {
+			s.lastSuccess = t
+		}
+	}
+
+	go s.regenerate()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(HEALTH_PATH, s.health)
+	mux.HandleFunc(s.root, s.serveSite)
+	if s.root != "/" {
+		mux.Handle(strings.TrimSuffix(s.root, "/"), http.RedirectHandler(s.root, http.StatusMovedPermanently))
+	}
+
+	log.Printf("Serving %s on %s", s.root, addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// regenerate generates the site immediately and then every refresh interval.
+func (s *server) regenerate() {
+	ticker := time.NewTicker(s.refresh)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		failed, err := s.g.generate(now, false /* dryRun */)
+		if len(failed) > 0 {
+			summarize(failed, s.g.size())
+		}
+		if err != nil {
+			log.Printf("Failed to generate the site: %s", err)
+		} else {
+			log.Printf("Published generation %s", now.Format(GENERATION_FORMAT))
+		}
+
+		s.mu.Lock()
+		s.lastAttempt, s.lastErr = now, err
+		if err == nil {
+			s.lastSuccess = now
+		}
+		s.mu.Unlock()
+
+		<-ticker.C
+	}
+}
+
+// health reports when the site was last generated. The site is unhealthy if
+// nothing has been generated or the last generation is more than two refresh
+// intervals old.
+func (s *server) health(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	h := Health{Status: "ok"}
+	if !s.lastSuccess.IsZero() {
+		t := s.lastSuccess
+		h.LastSuccess = &t
+	}
+	if !s.lastAttempt.IsZero() {
+		t := s.lastAttempt
+		h.LastAttempt = &t
+	}
+	if s.lastErr != nil {
+		h.Error = s.lastErr.Error()
+	}
+	s.mu.Unlock()
+
+	cur, err := s.g.site.Current()
+	if err != nil {
+		h.Error = err.Error()
+	}
+	h.Generation = cur
+
+	status := http.StatusOK
+	if h.LastSuccess == nil {
+		h.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	} else if time.Since(*h.LastSuccess) > 2*s.refresh {
+		h.Status = "stale"
+		status = http.StatusServiceUnavailable
+	}
+
+	j, err := json.MarshalIndent(&h, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	w.Write(append(j, '\n'))
+}
+
+// serveSite serves the files of the current generation, following the alias
+// symlinks and responding with the site's 404 page for anything missing.
+func (s *server) serveSite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dir, err := s.g.site.Served()
+	if err != nil {
+		log.Printf("%s %s: %s", r.Method, r.URL, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	} else if dir == "" {
+		http.Error(w, "the site has not been generated yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	p := path.Clean("/" + strings.TrimPrefix(r.URL.Path, s.root))
+	file := filepath.Join(dir, filepath.FromSlash(p))
+	fi, err := os.Stat(file)
+	if err == nil && fi.IsDir() {
+		fi, err = os.Stat(filepath.Join(file, "index.html"))
+	}
+	if err != nil {
+		notFound(w, r, dir, p)
+		return
+	}
+	if path.Base(p) == FEED_FILE {
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	}
+	http.ServeFile(w, r, file)
+}
+
+// notFound responds with the 404 page nearest to p, so that each region of a
+// site with several regions has its own.
+func notFound(w http.ResponseWriter, r *http.Request, dir, p string) {
+	var f *os.File
+	for {
+		var err error
+		f, err = os.Open(filepath.Join(dir, filepath.FromSlash(p), "404.html"))
+		if err == nil {
+			break
+		} else if p == "/" {
+			http.NotFound(w, r)
+			return
+		}
+		p = path.Dir(p)
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method != http.MethodHead {
+		io.Copy(w, f)
+	}
+}
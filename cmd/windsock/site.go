@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GENERATIONS_SUFFIX is appended to the output path to name the directory
+// holding each generation of the site.
+const GENERATIONS_SUFFIX = ".generations"
+
+// STAGING_SUFFIX marks a generation which is still being rendered.
+const STAGING_SUFFIX = ".staging"
+
+// GENERATION_FORMAT names generations such that they sort chronologically.
+const GENERATION_FORMAT = "20060102T150405"
+
+// GENERATION_TIME_REGEXP matches the generation time embedded in every page,
+// JSON document and calendar, which is ignored when determining whether a page
+// has changed.
+var GENERATION_TIME_REGEXP = regexp.MustCompile(`<div id="?generation-time"?>[^<]*</div>|"generated":"[^"]*"|DTSTAMP:\w*`)
+
+// Site is an output path which is a symlink to the current generation of the
+// site. Generations are rendered into a staging directory alongside the
+// others and the symlink is atomically swapped once rendering succeeds, so the
+// served site is never empty or half-written.
+type Site struct {
+	path string
+	// Number of generations to keep for rollback.
+	keep int
+}
+
+func NewSite(path string, keep int) *Site {
+	if keep < 1 {
+		keep = 1
+	}
+	return &Site{path: filepath.Clean(path), keep: keep}
+}
+
+func (s *Site) generations() string {
+	return s.path + GENERATIONS_SUFFIX
+}
+
+// Stage returns a new empty directory to render the generation at t into.
+func (s *Site) Stage(t time.Time) (string, error) {
+	dir := filepath.Join(s.generations(), t.Format(GENERATION_FORMAT)+STAGING_SUFFIX)
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return "", err
+	}
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// Publish makes the staged generation current and prunes old generations.
+func (s *Site) Publish(staging string) error {
+	final := strings.TrimSuffix(staging, STAGING_SUFFIX)
+	if _, err := os.Lstat(final); err == nil {
+		return fmt.Errorf("generation already exists: %s", final)
+	}
+
+	err := s.migrate()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(staging, final)
+	if err != nil {
+		return err
+	}
+	err = s.swap(filepath.Base(final))
+	if err != nil {
+		return err
+	}
+	return s.prune()
+}
+
+// Rollback makes the generation before the current one current.
+func (s *Site) Rollback() (string, error) {
+	gens, err := s.list()
+	if err != nil {
+		return "", err
+	}
+	cur, err := s.Current()
+	if err != nil {
+		return "", err
+	}
+
+	for i := len(gens) - 1; i > 0; i-- {
+		if gens[i] == cur {
+			return gens[i-1], s.swap(gens[i-1])
+		}
+	}
+	return "", fmt.Errorf("no generation before %q to roll back to", cur)
+}
+
+// Current returns the name of the current generation, or "" if there is none.
+func (s *Site) Current() (string, error) {
+	fi, err := os.Lstat(s.path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		// A site rendered before generations existed.
+		return "", nil
+	}
+
+	target, err := os.Readlink(s.path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(target), nil
+}
+
+// Served returns the directory currently being served, or "" if there is none.
+func (s *Site) Served() (string, error) {
+	cur, err := s.Current()
+	if err != nil || cur != "" {
+		return s.Dir(cur), err
+	}
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return "", nil
+	}
+	return s.path, nil
+}
+
+// Dir returns the directory of the named generation.
+func (s *Site) Dir(name string) string {
+	return filepath.Join(s.generations(), name)
+}
+
+// list returns the names of the published generations from oldest to newest.
+func (s *Site) list() ([]string, error) {
+	fis, err := ioutil.ReadDir(s.generations())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var gens []string
+	for _, fi := range fis {
+		if fi.IsDir() && !strings.HasSuffix(fi.Name(), STAGING_SUFFIX) {
+			gens = append(gens, fi.Name())
+		}
+	}
+	sort.Strings(gens)
+	return gens, nil
+}
+
+// swap atomically points the output path at the named generation by renaming
+// a new symlink over it.
+func (s *Site) swap(name string) error {
+	target := filepath.Join(filepath.Base(s.generations()), name)
+	tmp := s.path + ".swap"
+	err := os.Remove(tmp)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Symlink(target, tmp)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// migrate moves a site rendered before generations existed into the
+// generations directory so that the output path can become a symlink.
+func (s *Site) migrate() error {
+	fi, err := os.Lstat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 || !fi.IsDir() {
+		return nil
+	}
+
+	err = os.MkdirAll(s.generations(), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(s.path, s.Dir(fi.ModTime().Format(GENERATION_FORMAT)))
+}
+
+// prune removes all but the newest generations, never removing the current
+// generation.
+func (s *Site) prune() error {
+	gens, err := s.list()
+	if err != nil {
+		return err
+	}
+	cur, err := s.Current()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(gens)-s.keep; i++ {
+		if gens[i] == cur {
+			continue
+		}
+		err = os.RemoveAll(s.Dir(gens[i]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SiteChanges are the paths of the pages which differ between generations.
+type SiteChanges struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+func (c *SiteChanges) String() string {
+	var buf bytes.Buffer
+	for _, p := range c.Added {
+		fmt.Fprintf(&buf, "+ %s\n", p)
+	}
+	for _, p := range c.Removed {
+		fmt.Fprintf(&buf, "- %s\n", p)
+	}
+	for _, p := range c.Changed {
+		fmt.Fprintf(&buf, "~ %s\n", p)
+	}
+	fmt.Fprintf(&buf, "%d added, %d removed, %d changed", len(c.Added), len(c.Removed), len(c.Changed))
+	return buf.String()
+}
+
+// diffSites compares the files of the before and after directories, either
+// of which may not exist. Symlinks are compared by their targets.
+func diffSites(before, after string) (*SiteChanges, error) {
+	b, err := siteFiles(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := siteFiles(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := &SiteChanges{}
+	for p, ac := range a {
+		bc, ok := b[p]
+		if !ok {
+			changes.Added = append(changes.Added, p)
+		} else if !bytes.Equal(ac, bc) {
+			changes.Changed = append(changes.Changed, p)
+		}
+	}
+	for p := range b {
+		if _, ok := a[p]; !ok {
+			changes.Removed = append(changes.Removed, p)
+		}
+	}
+
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Changed)
+	return changes, nil
+}
+
+// siteFiles returns the contents of each file under dir keyed by its relative
+// path, with any generation times removed.
+func siteFiles(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	if dir == "" {
+		return files, nil
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return files, nil
+	}
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			files[rel] = []byte("-> " + target)
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[rel] = GENERATION_TIME_REGEXP.ReplaceAll(data, nil)
+		return nil
+	})
+	return files, err
+}
@@ -18,6 +18,14 @@ var SLUG_REGEXP = regexp.MustCompile("[^\\p{L}\\d]+")
 type ClimbForecast struct {
 	Climb    *Climb
 	Forecast *ScoredForecast
+	// Err is set if the forecast for the climb could not be fetched or scored.
+	Err error
+	// The forecast as fetched, before being trimmed and scored.
+	raw *weather.Forecast
+}
+
+func (f *ClimbForecast) Unavailable() bool {
+	return f.Err != nil
 }
 
 func (f *ClimbForecast) Slug() string {
@@ -108,10 +116,13 @@ type LayoutTmpl struct {
 	GenerationTime time.Time
 	AbsoluteURL    string
 	CanonicalPath  string
+	Region         string
 	Title          string
-	Historical     bool
-	Default        bool
-	SingleSegment  bool
+	// FeedTitle is the title of the site's Atom feed, empty if it has none.
+	FeedTitle     string
+	Historical    bool
+	Default       bool
+	SingleSegment bool
 }
 
 func (t *LayoutTmpl) RootedPath(p string) string {
@@ -154,6 +165,29 @@ type RootTmpl struct {
 	Forecasts []*ClimbForecast
 }
 
+type RegionsTmpl struct {
+	LayoutTmpl
+	Regions []*RegionTmpl
+}
+
+type RegionTmpl struct {
+	Name   string
+	Slug   string
+	URL    string
+	Climbs int
+	// The (non-hidden) climbs with the best conditions by each score, if any.
+	historical *ClimbForecast
+	baseline   *ClimbForecast
+}
+
+func (r *RegionTmpl) Best(historical bool) *ClimbForecast {
+	if historical {
+		return r.historical
+	} else {
+		return r.baseline
+	}
+}
+
 type DayTimeTmpl struct {
 	LayoutTmpl
 	LocalTime  time.Time
@@ -189,10 +223,13 @@ func (c *ClimbConditions) ClimbDirection() string {
 
 type ClimbTmpl struct {
 	LayoutTmpl
-	Climb     *Climb
-	Days      []string
-	ShortDays []string
-	Rows      []*ClimbTmplRow
+	Climb       *Climb
+	Days        []string
+	ShortDays   []string
+	Rows        []*ClimbTmplRow
+	Unavailable bool
+	// Whether the climb's maps were rendered.
+	Map bool
 	Navigation
 }
 
@@ -3,145 +3,381 @@ package main
 import (
 	"flag"
 	"fmt"
+	"html/template"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"time"
 
+	"github.com/scheibo/geo"
 	. "github.com/scheibo/stravutils"
 	"github.com/scheibo/weather"
 )
 
 const msToKmh = 3600.0 / 1000.0
 
+// ARCHIVE_SUFFIX is appended to the output path to name the default directory
+// forecasts are archived into.
+const ARCHIVE_SUFFIX = ".archive"
+
 const minHour = 6
 const maxHour = 18
 
 func main() {
 	var segmentID int64
-	var output, key, climbsFile, hiddenFile, absoluteURL string
-	var historical bool
-	var min, max int
+	var output, key, configFile, alertsFile, archive, name, tz, climbsFile, hiddenFile, averagesFile, absoluteURL, addr string
+	var historical, dryRun, rollback, serve bool
+	var min, max, workers, keep int
+	var threshold float64
+	var refresh time.Duration
 
 	flag.Int64Var(&segmentID, "segmentID", 0, "Render a specific segment's climb page to the current directory and then exit.")
 	flag.BoolVar(&historical, "historical", false, "Default to historical instead of baseline")
 	flag.StringVar(&absoluteURL, "absoluteURL", "https://bayarea.climberrankings.com/climbs/windsock", "Absolute root URL of the site")
-	flag.StringVar(&output, "output", "site", "Output directory")
+	flag.StringVar(&output, "output", "site", "Output path, a symlink to the current generation of the site")
+	flag.IntVar(&keep, "keep", 3, "Number of generations of the site to keep for rollback")
+	flag.BoolVar(&dryRun, "dryRun", false, "Report which pages would change instead of publishing the site")
+	flag.BoolVar(&rollback, "rollback", false, "Roll the site back to the previous generation and then exit")
 	flag.StringVar(&key, "key", "", "DarkySky API Key")
+	flag.StringVar(&configFile, "config", "", "Regions to generate into subdirectories of the site, instead of the region configured by flags")
+	flag.StringVar(&name, "region", "Bay Area", "Name of the region")
+	flag.StringVar(&tz, "tz", "America/Los_Angeles", "Time zone of the region")
 	flag.StringVar(&climbsFile, "climbs", "", "Climbs")
 	flag.StringVar(&hiddenFile, "hidden", "", "Bonus hidden segments to include in the output")
+	flag.StringVar(&averagesFile, "averages", "", "Historical average weather conditions of the climbs")
 	flag.IntVar(&min, "min", 6, "Minimum hour [0-23] to include in forecasts")
 	flag.IntVar(&max, "max", 18, "Maximum hour [0-23] to include in forecasts")
+	flag.IntVar(&workers, "workers", 8, "Number of forecasts to fetch in parallel")
+	flag.BoolVar(&serve, "serve", false, "Serve the site over HTTP, regenerating it every refresh interval")
+	flag.StringVar(&addr, "addr", "localhost:8080", "Address to listen on with -serve")
+	flag.DurationVar(&refresh, "refresh", time.Hour, "How often to regenerate the site with -serve")
+	flag.StringVar(&archive, "archive", "", "Directory to archive each generation's forecasts into for verification, defaults to alongside the output path")
+	flag.StringVar(&alertsFile, "alerts", "", "Alert rules to fire after each generation, recording those which have fired alongside the output path")
+	flag.Float64Var(&threshold, "threshold", -5, "Add a climb's best upcoming conditions to the feed when its score is better than this percentage")
 
 	flag.Parse()
 
 	genTime := time.Now()
+	site := NewSite(output, keep)
 
-	if min < 0 || max > 23 || min >= max {
-		exit(fmt.Errorf("min and max must be in the range [0-23] with min < max but got min=%d max=%d", min, max))
+	if rollback {
+		gen, err := site.Rollback()
+		if err != nil {
+			exit(err)
+		}
+		fmt.Printf("Rolled back to %s\n", gen)
+		return
 	}
 
-	loc, err := time.LoadLocation("America/Los_Angeles")
-	if err != nil {
-		exit(err)
+	var regions []Region
+	if configFile != "" {
+		var err error
+		regions, err = GetRegions(configFile, absoluteURL)
+		if err != nil {
+			exit(err)
+		}
+	} else {
+		regions = []Region{{
+			Name:        name,
+			Slug:        slugify(name),
+			AbsoluteURL: absoluteURL,
+			TimeZone:    tz,
+			Climbs:      climbsFile,
+			Hidden:      hiddenFile,
+			Historical:  averagesFile,
+			MinHour:     min,
+			MaxHour:     max,
+		}}
 	}
 
-	climbs, err := GetClimbs(climbsFile)
-	if err != nil {
-		exit(err)
+	var loaded []*region
+	for _, cfg := range regions {
+		r, err := loadRegion(cfg, key)
+		if err != nil {
+			exit(err)
+		}
+		loaded = append(loaded, r)
 	}
 
 	templates := getTemplates()
-	w := weather.NewClient(weather.DarkSky(key), weather.TimeZone(loc))
 
 	if segmentID != 0 {
-		s, err := GetSegmentByID(segmentID, climbs)
+		r := loaded[0]
+		for _, l := range loaded {
+			if l.has(segmentID) {
+				r = l
+				break
+			}
+		}
+
+		s, err := GetSegmentByID(segmentID, r.climbs)
 		if err != nil {
 			exit(err)
 		}
 		c := Climb{Name: s.Name, Segment: *s}
-		cf, err := getClimbForecast(&c, w, nil /* havgs */, min, max, loc)
+		cf, err := getClimbForecast(&c, r.w, nil /* havgs */, r.MinHour, r.MaxHour, r.loc)
 		if err != nil {
 			exit(err)
 		}
 		forecasts := []*ClimbForecast{cf}
 		err = NewRenderer(
+			r.Name,
 			false, /* historical */
-			absoluteURL,
+			r.AbsoluteURL,
 			"", /* output */
 			forecasts,
 			0,   /* hidden */
 			nil, /* havgs */
 			genTime,
-			loc).renderSegment(templates)
+			r.loc).renderSegment(templates)
 		if err != nil {
 			exit(err)
 		}
 		return
 	}
 
-	hidden := len(climbs)
-	if hiddenFile != "" {
-		hs, err := GetClimbs(hiddenFile)
+	for _, r := range loaded {
+		err := r.loadAverages()
 		if err != nil {
 			exit(err)
 		}
+	}
 
-		for _, h := range hs {
-			climbs = append(climbs, h)
-		}
+	if archive == "" {
+		archive = site.path + ARCHIVE_SUFFIX
 	}
 
-	// NOTE: we expect all days to be present and will segfault if there are any are null.
-	havgs, err := GetHistoricalAverages()
-	if err != nil {
-		exit(err)
+	g := &generator{
+		site:        site,
+		archive:     archive,
+		regions:     loaded,
+		nested:      configFile != "",
+		absoluteURL: absoluteURL,
+		templates:   templates,
+		historical:  historical,
+		workers:     workers,
+		threshold:   threshold,
 	}
 
-	var forecasts []*ClimbForecast
-	for _, climb := range climbs {
-		c := climb
-		cf, err := getClimbForecast(&c, w, &havgs, min, max, loc)
+	if alertsFile != "" {
+		config, err := GetAlertConfig(alertsFile)
 		if err != nil {
 			exit(err)
 		}
-		forecasts = append(forecasts, cf)
+		g.alerter = newAlerter(config, site.path+ALERT_STATE_SUFFIX)
+	}
+
+	if serve {
+		if dryRun {
+			exit(fmt.Errorf("-dryRun can't be used with -serve"))
+		}
+		if refresh <= 0 {
+			exit(fmt.Errorf("refresh must be positive but got %s", refresh))
+		}
+		exit(newServer(g, absoluteURL, refresh).listenAndServe(addr))
 	}
 
-	err = NewRenderer(historical, absoluteURL, output, forecasts, hidden, &havgs, genTime, loc).render(templates)
+	failed, err := g.generate(genTime, dryRun)
+	if len(failed) > 0 {
+		summarize(failed, g.size())
+	}
 	if err != nil {
 		exit(err)
 	}
 }
 
-func getClimbForecast(c *Climb, w *weather.Client, h *HistoricalClimbAverages, min, max int, loc *time.Location) (*ClimbForecast, error) {
-	const maxAttempts = 10                     // Maximum number of retry attempts
-	const baseBackoff = 100 * time.Millisecond // Initial backoff time
-	const maxBackoff = 5 * time.Second         // Maximum backoff time
-	const jitterFactor = 0.5                   // Jitter factor
+// generator renders generations of the site from freshly fetched forecasts.
+type generator struct {
+	site *Site
+	// The directory each generation's forecasts are archived into.
+	archive string
+	regions []*region
+	// Whether each region is rendered into its own subdirectory alongside an
+	// index of the regions, as opposed to a single region at the root.
+	nested      bool
+	absoluteURL string
+	templates   map[string]*template.Template
+	historical  bool
+	workers     int
+	threshold   float64
+	// Fires alerts after each generation, if configured.
+	alerter *alerter
+}
 
-	var f *weather.Forecast
-	var err error
+// size returns the number of climbs in every region.
+func (g *generator) size() int {
+	n := 0
+	for _, r := range g.regions {
+		n += len(r.climbs)
+	}
+	return n
+}
 
-	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		// Exponential backoff with jitter
-    backoff := time.Duration(float64(baseBackoff) * float64(uint(1) << uint(attempt)) * (1 + (rand.Float64()-0.5)*jitterFactor))
+// generate renders the generation of the site at now and publishes it, or if
+// dryRun reports which pages would change instead. The climbs whose forecasts
+// were unavailable are returned. The site is only rendered if at least one
+// forecast was available for every region, as otherwise the region's pages
+// would disappear.
+func (g *generator) generate(now time.Time, dryRun bool) ([]*ClimbForecast, error) {
+	var failed []*ClimbForecast
+	forecasts := make([][]*ClimbForecast, len(g.regions))
+	for i, r := range g.regions {
+		forecasts[i] = getClimbForecasts(r.climbs, r.w, r.havgs, r.MinHour, r.MaxHour, r.loc, g.workers)
+
+		n := 0
+		for _, cf := range forecasts[i] {
+			if cf.Unavailable() {
+				failed = append(failed, cf)
+				n++
+			}
+		}
+		if n > 0 && n == len(forecasts[i]) {
+			return failed, fmt.Errorf("no forecasts were available for %s", r.Name)
+		}
+	}
 
-		if backoff > maxBackoff {
-			backoff = maxBackoff
+	previous, err := g.site.Served()
+	if err != nil {
+		return failed, err
+	}
+	staging, err := g.site.Stage(now)
+	if err != nil {
+		return failed, err
+	}
+
+	err = g.render(now, staging, previous, forecasts)
+	if err == nil && dryRun {
+		err = report(g.site, staging)
+	}
+	if err != nil || dryRun {
+		os.RemoveAll(staging)
+	} else {
+		err = g.site.Publish(staging)
+	}
+	if err != nil {
+		return failed, err
+	}
+
+	// The site has been published regardless of whether the forecasts can be
+	// archived or alerts can be sent.
+	if !dryRun {
+		err = g.archiveForecasts(now, forecasts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+	}
+	if g.alerter != nil {
+		err = g.alerter.fire(now, g.regions, forecasts, dryRun)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
 		}
+	}
+	return failed, nil
+}
 
-		// Wait for backoff duration
-		time.Sleep(backoff)
+// archiveForecasts archives the forecasts of every climb which were available.
+func (g *generator) archiveForecasts(now time.Time, forecasts [][]*ClimbForecast) error {
+	a := &ForecastArchive{Version: ARCHIVE_VERSION, Generated: now}
+	for _, fs := range forecasts {
+		for _, cf := range fs {
+			if cf.raw != nil {
+				a.Forecasts = append(a.Forecasts, NewArchivedForecast(&cf.Climb.Segment, cf.raw))
+			}
+		}
+	}
+	return WriteForecastArchive(g.archive, a)
+}
 
-		// Attempt to fetch forecast
-		f, err = w.Forecast(c.Segment.AverageLocation)
-		if err == nil {
-			break // Success, exit retry loop
+// render renders each region's forecasts into staging, along with the index of
+// the regions if they're nested.
+func (g *generator) render(now time.Time, staging, previous string, forecasts [][]*ClimbForecast) error {
+	for i, r := range g.regions {
+		dir, prev := staging, previous
+		if g.nested {
+			dir = filepath.Join(staging, r.Slug)
+			if previous != "" {
+				prev = filepath.Join(previous, r.Slug)
+			}
+		}
+
+		renderer := NewRenderer(r.Name, g.historical, r.AbsoluteURL, dir, forecasts[i], r.hidden, r.havgs, now, r.loc)
+		renderer.previous, renderer.threshold = prev, g.threshold
+		err := renderer.render(g.templates)
+		if err != nil {
+			return err
 		}
 	}
 
+	if !g.nested {
+		return nil
+	}
+	return g.renderRegions(now, staging, forecasts)
+}
+
+// report prints the pages of the staged generation which differ from the
+// current generation.
+func report(site *Site, staging string) error {
+	before, err := site.Served()
+	if err != nil {
+		return err
+	}
+
+	changes, err := diffSites(before, staging)
+	if err != nil {
+		return err
+	}
+	fmt.Println(changes)
+	return nil
+}
+
+// summarize reports the climbs whose forecasts were unavailable.
+func summarize(failed []*ClimbForecast, total int) {
+	fmt.Fprintf(os.Stderr, "%d/%d forecasts unavailable:\n", len(failed), total)
+	for _, cf := range failed {
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", cf.Climb.Name, cf.Err)
+	}
+}
+
+// getClimbForecasts fetches and scores the forecast of each climb using up to
+// workers goroutines. A climb whose forecast can't be fetched or scored is
+// marked as unavailable instead of failing the others.
+func getClimbForecasts(climbs []Climb, w *weather.Client, h *HistoricalClimbAverages, min, max int, loc *time.Location, workers int) []*ClimbForecast {
+	if workers < 1 {
+		workers = 1
+	}
+
+	forecasts := make([]*ClimbForecast, len(climbs))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				c := &climbs[j]
+				cf, err := getClimbForecast(c, w, h, min, max, loc)
+				if err != nil {
+					cf = &ClimbForecast{Climb: c, Forecast: &ScoredForecast{}, Err: err}
+				}
+				forecasts[j] = cf
+			}
+		}()
+	}
+
+	for j := range climbs {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+
+	return forecasts
+}
+
+func getClimbForecast(c *Climb, w *weather.Client, h *HistoricalClimbAverages, min, max int, loc *time.Location) (*ClimbForecast, error) {
+	f, err := fetchForecast(w, c.Segment.AverageLocation)
 	if err != nil {
 		return nil, err
 	}
@@ -150,9 +386,38 @@ func getClimbForecast(c *Climb, w *weather.Client, h *HistoricalClimbAverages, m
 	if err != nil {
 		return nil, err
 	}
+	cf.raw = f
 	return cf, nil
 }
 
+// fetchForecast fetches the forecast for ll, retrying with exponential backoff
+// and jitter after each failed attempt.
+func fetchForecast(w *weather.Client, ll geo.LatLng) (*weather.Forecast, error) {
+	const maxAttempts = 5                      // Maximum number of attempts
+	const baseBackoff = 250 * time.Millisecond // Backoff after the first failure
+	const maxBackoff = 5 * time.Second         // Maximum backoff time
+	const jitterFactor = 0.5                   // Jitter factor
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		var f *weather.Forecast
+		f, err = w.Forecast(ll)
+		if err == nil {
+			return f, nil
+		}
+		if attempt == maxAttempts {
+			break
+		}
+
+		backoff := time.Duration(float64(baseBackoff) * float64(uint(1)<<uint(attempt-1)) * (1 + (rand.Float64()-0.5)*jitterFactor))
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		time.Sleep(backoff)
+	}
+	return nil, fmt.Errorf("failed after %d attempts: %s", maxAttempts, err)
+}
+
 func trimAndScore(h *HistoricalClimbAverages, c *Climb, f *weather.Forecast, min, max int, loc *time.Location) (*ClimbForecast, error) {
 	scored := ScoredForecast{}
 	result := &ClimbForecast{Climb: c, Forecast: &scored}
@@ -0,0 +1,382 @@
+package stravutils
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/scheibo/calc"
+)
+
+const CP2 = "CP2"
+const CP3 = "CP3"
+const OMPD = "OmPD"
+
+// OMPD_TCPMAX is the duration in seconds after which the Omni-domain model
+// begins to decay below CP.
+const OMPD_TCPMAX = 1800.0
+
+// MAX_DURATION is the longest duration in seconds power-duration models are
+// evaluated for.
+const MAX_DURATION = 6 * 3600.0
+
+// PowerDurationPoint is a single observation of Power in watts maintained for
+// Duration seconds.
+type PowerDurationPoint struct {
+	Power    float64   `json:"power"`
+	Duration float64   `json:"duration"`
+	Date     time.Time `json:"date,omitempty"`
+	// Weight of the point when fitting, treated as 1 if unset.
+	Weight float64 `json:"weight,omitempty"`
+}
+
+func (p *PowerDurationPoint) weight() float64 {
+	if p.Weight <= 0 {
+		return 1
+	}
+	return p.Weight
+}
+
+// CurveModel is a power-duration model fitted to a set of PowerDurationPoints.
+type CurveModel struct {
+	Model string `json:"model"`
+	// Critical power in watts.
+	CP float64 `json:"cp"`
+	// Work capacity above CP in joules.
+	WPrime float64 `json:"w_prime"`
+	// Maximal instantaneous power in watts (CP3 and OmPD only).
+	Pmax float64 `json:"pmax,omitempty"`
+	// Rate of decline in watts per ln(t) beyond OMPD_TCPMAX (OmPD only).
+	A float64 `json:"a,omitempty"`
+	// Weighted coefficient of determination of the fit.
+	R2 float64 `json:"r2"`
+	// Root mean squared error of the fit in watts.
+	RMSE float64 `json:"rmse"`
+}
+
+// Power returns the power the model predicts can be maintained for t seconds.
+func (m *CurveModel) Power(t float64) float64 {
+	switch m.Model {
+	case CP3:
+		return m.CP + m.WPrime/(t+m.WPrime/(m.Pmax-m.CP))
+	case OMPD:
+		p := m.WPrime/t*(1-math.Exp(-t*(m.Pmax-m.CP)/m.WPrime)) + m.CP
+		if t > OMPD_TCPMAX {
+			p -= m.A * math.Log(t/OMPD_TCPMAX)
+		}
+		return p
+	default:
+		return m.CP + m.WPrime/t
+	}
+}
+
+// Duration returns the time in seconds the model predicts power p can be
+// maintained for, up to MAX_DURATION.
+func (m *CurveModel) Duration(p float64) float64 {
+	return searchDuration(m.Power, p)
+}
+
+func (m *CurveModel) String() string {
+	s := fmt.Sprintf("%s: CP=%.1fW W'=%.0fJ", m.Model, m.CP, m.WPrime)
+	if m.Pmax > 0 {
+		s += fmt.Sprintf(" Pmax=%.0fW", m.Pmax)
+	}
+	if m.A != 0 {
+		s += fmt.Sprintf(" A=%.2f", m.A)
+	}
+	return s + fmt.Sprintf(" (R²=%.4f, RMSE=%.1fW)", m.R2, m.RMSE)
+}
+
+// FitCurves fits all of the power-duration models which the points are
+// sufficient to determine.
+func FitCurves(points []PowerDurationPoint) ([]*CurveModel, error) {
+	var models []*CurveModel
+	for _, fit := range []func([]PowerDurationPoint) (*CurveModel, error){FitCP2, FitCP3, FitOmPD} {
+		m, err := fit(points)
+		if err != nil {
+			if len(models) == 0 {
+				return nil, err
+			}
+			continue
+		}
+		models = append(models, m)
+	}
+	return models, nil
+}
+
+// FitCP2 fits the 2-parameter critical power model P = CP + W'/t using
+// weighted linear regression of work against time.
+func FitCP2(points []PowerDurationPoint) (*CurveModel, error) {
+	if distinct(points) < 2 {
+		return nil, fmt.Errorf("%s requires at least 2 distinct durations", CP2)
+	}
+
+	var sw, sx, sy, sxx, sxy float64
+	for _, p := range points {
+		w := p.weight()
+		x, y := p.Duration, p.Power*p.Duration
+		sw += w
+		sx += w * x
+		sy += w * y
+		sxx += w * x * x
+		sxy += w * x * y
+	}
+
+	cp := (sw*sxy - sx*sy) / (sw*sxx - sx*sx)
+	m := &CurveModel{Model: CP2, CP: cp, WPrime: (sy - cp*sx) / sw}
+	m.R2, m.RMSE = goodness(m, points)
+	return m, nil
+}
+
+// FitCP3 fits Morton's 3-parameter critical power model.
+func FitCP3(points []PowerDurationPoint) (*CurveModel, error) {
+	if distinct(points) < 3 {
+		return nil, fmt.Errorf("%s requires at least 3 distinct durations", CP3)
+	}
+
+	cp2, err := FitCP2(points)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &CurveModel{Model: CP3}
+	x := minimize(func(x []float64) float64 {
+		m.CP, m.WPrime, m.Pmax = x[0], x[1], x[2]
+		if m.WPrime <= 0 || m.Pmax <= m.CP {
+			return math.Inf(1)
+		}
+		return sse(m, points)
+	}, []float64{cp2.CP, cp2.WPrime, cp2.CP + cp2.WPrime/10},
+		[]float64{cp2.CP / 10, cp2.WPrime / 10, cp2.CP})
+
+	m.CP, m.WPrime, m.Pmax = x[0], x[1], x[2]
+	m.R2, m.RMSE = goodness(m, points)
+	return m, nil
+}
+
+// FitOmPD fits the Omni-domain power-duration model (Puchowicz et al. 2020).
+// The long duration decay parameter A is only fitted if there are points
+// longer than OMPD_TCPMAX.
+func FitOmPD(points []PowerDurationPoint) (*CurveModel, error) {
+	if distinct(points) < 3 {
+		return nil, fmt.Errorf("%s requires at least 3 distinct durations", OMPD)
+	}
+
+	cp3, err := FitCP3(points)
+	if err != nil {
+		return nil, err
+	}
+
+	long := false
+	for _, p := range points {
+		long = long || p.Duration > OMPD_TCPMAX
+	}
+
+	m := &CurveModel{Model: OMPD}
+	x0 := []float64{cp3.CP, cp3.WPrime, cp3.Pmax, 0}
+	steps := []float64{cp3.CP / 10, cp3.WPrime / 10, cp3.Pmax / 10, 5}
+	if !long || distinct(points) < 4 {
+		x0, steps = x0[:3], steps[:3]
+	}
+
+	x := minimize(func(x []float64) float64 {
+		m.CP, m.WPrime, m.Pmax = x[0], x[1], x[2]
+		if len(x) > 3 {
+			m.A = x[3]
+		}
+		if m.WPrime <= 0 || m.Pmax <= m.CP || m.A < 0 {
+			return math.Inf(1)
+		}
+		return sse(m, points)
+	}, x0, steps)
+
+	m.CP, m.WPrime, m.Pmax = x[0], x[1], x[2]
+	if len(x) > 3 {
+		m.A = x[3]
+	}
+	m.R2, m.RMSE = goodness(m, points)
+	return m, nil
+}
+
+func distinct(points []PowerDurationPoint) int {
+	durations := make(map[float64]bool)
+	for _, p := range points {
+		durations[p.Duration] = true
+	}
+	return len(durations)
+}
+
+func sse(m *CurveModel, points []PowerDurationPoint) float64 {
+	s := 0.0
+	for _, p := range points {
+		r := p.Power - m.Power(p.Duration)
+		s += p.weight() * r * r
+	}
+	return s
+}
+
+func goodness(m *CurveModel, points []PowerDurationPoint) (r2, rmse float64) {
+	var sw, mean float64
+	for _, p := range points {
+		sw += p.weight()
+		mean += p.weight() * p.Power
+	}
+	mean /= sw
+
+	var tot float64
+	for _, p := range points {
+		d := p.Power - mean
+		tot += p.weight() * d * d
+	}
+
+	res := sse(m, points)
+	if tot > 0 {
+		r2 = 1 - res/tot
+	}
+	rmse = math.Sqrt(res / sw)
+	return
+}
+
+func searchDuration(power func(float64) float64, p float64) float64 {
+	// epsilon is some small value that determines when we will stop the search
+	const epsilon = 1e-6
+	// max is the maxmium number of iterations of the search
+	const max = 100
+
+	tl, tm, th := 0.0, MAX_DURATION/2, MAX_DURATION
+	for j := 0; j < max; j++ {
+		p1 := power(tm)
+		if calc.Eqf(p1, p, epsilon) {
+			break
+		}
+
+		if p1 > p {
+			tl = tm
+		} else {
+			th = tm
+		}
+
+		tm = (th + tl) / 2.0
+	}
+
+	return tm
+}
+
+// minimize finds a local minimum of f using the Nelder-Mead simplex method
+// starting from x0 with initial step sizes steps.
+func minimize(f func([]float64) float64, x0, steps []float64) []float64 {
+	// max is the maxmium number of iterations of the search
+	const max = 5000
+	// epsilon is some small value that determines when we will stop the search
+	const epsilon = 1e-10
+
+	n := len(x0)
+	type vertex struct {
+		x []float64
+		f float64
+	}
+
+	simplex := make([]vertex, n+1)
+	for i := range simplex {
+		x := append([]float64(nil), x0...)
+		if i > 0 {
+			x[i-1] += steps[i-1]
+		}
+		simplex[i] = vertex{x, f(x)}
+	}
+
+	point := func(c []float64, to []float64, a float64) vertex {
+		x := make([]float64, n)
+		for i := range x {
+			x[i] = c[i] + a*(to[i]-c[i])
+		}
+		return vertex{x, f(x)}
+	}
+
+	for j := 0; j < max; j++ {
+		sort.Slice(simplex, func(a, b int) bool { return simplex[a].f < simplex[b].f })
+		best, worst := simplex[0], simplex[n]
+		if math.Abs(worst.f-best.f) <= epsilon*(math.Abs(best.f)+epsilon) {
+			break
+		}
+
+		centroid := make([]float64, n)
+		for _, v := range simplex[:n] {
+			for i := range centroid {
+				centroid[i] += v.x[i] / float64(n)
+			}
+		}
+
+		reflected := point(centroid, worst.x, -1)
+		switch {
+		case reflected.f < best.f:
+			expanded := point(centroid, worst.x, -2)
+			if expanded.f < reflected.f {
+				simplex[n] = expanded
+			} else {
+				simplex[n] = reflected
+			}
+		case reflected.f < simplex[n-1].f:
+			simplex[n] = reflected
+		default:
+			contracted := point(centroid, worst.x, 0.5)
+			if contracted.f < worst.f {
+				simplex[n] = contracted
+				continue
+			}
+			for k := 1; k <= n; k++ {
+				simplex[k] = point(best.x, simplex[k].x, 0.5)
+			}
+		}
+	}
+
+	sort.Slice(simplex, func(a, b int) bool { return simplex[a].f < simplex[b].f })
+	return simplex[0].x
+}
+
+// GetPowerPoints returns the PowerDurationPoints for each of the efforts on
+// climbs which were recorded with a power meter.
+func GetPowerPoints(climbs []Climb, maxPages int, tokens ...string) ([]PowerDurationPoint, error) {
+	var points []PowerDurationPoint
+	for _, c := range climbs {
+		efforts, err := GetEfforts(c.Segment.ID, maxPages, tokens...)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range efforts {
+			if !e.DeviceWatts || e.AverageWatts <= 0 || e.ElapsedTime <= 0 {
+				continue
+			}
+			points = append(points, PowerDurationPoint{
+				Power:    float64(e.AverageWatts),
+				Duration: float64(e.ElapsedTime),
+				Date:     e.StartDate,
+			})
+		}
+	}
+	return points, nil
+}
+
+// Envelope returns the points which are not dominated by any other point, ie.
+// where no other point has both a higher power and a longer duration.
+func Envelope(points []PowerDurationPoint) []PowerDurationPoint {
+	sorted := append([]PowerDurationPoint(nil), points...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Duration == sorted[j].Duration {
+			return sorted[i].Power > sorted[j].Power
+		}
+		return sorted[i].Duration > sorted[j].Duration
+	})
+
+	var envelope []PowerDurationPoint
+	max := 0.0
+	for _, p := range sorted {
+		if p.Power > max {
+			envelope = append(envelope, p)
+			max = p.Power
+		}
+	}
+	return envelope
+}
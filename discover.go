@@ -0,0 +1,364 @@
+package stravutils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/scheibo/geo"
+	"github.com/scheibo/strava"
+)
+
+// EXPLORE_LIMIT is the maximum number of segments Strava returns per explore
+// request.
+const EXPLORE_LIMIT = 10
+
+// MAX_CATEGORY is the climb category of a HC climb, 0 is uncategorized.
+const MAX_CATEGORY = 5
+
+// Bounds is a rectangular region described by its south west and north east
+// corners.
+type Bounds struct {
+	SW geo.LatLng `json:"sw"`
+	NE geo.LatLng `json:"ne"`
+}
+
+// ParseBounds parses a 'sw_lat,sw_lng,ne_lat,ne_lng' string.
+func ParseBounds(s string) (Bounds, error) {
+	var f [4]float64
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return Bounds{}, fmt.Errorf("expected 'sw_lat,sw_lng,ne_lat,ne_lng' but got %s", s)
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return Bounds{}, err
+		}
+		f[i] = v
+	}
+
+	b := Bounds{SW: geo.LatLng{Lat: f[0], Lng: f[1]}, NE: geo.LatLng{Lat: f[2], Lng: f[3]}}
+	if b.SW.Lat >= b.NE.Lat || b.SW.Lng >= b.NE.Lng {
+		return Bounds{}, fmt.Errorf("south west corner must be below and left of north east corner: %s", s)
+	}
+	return b, nil
+}
+
+func (b Bounds) String() string {
+	return fmt.Sprintf("%s,%s", b.SW.String(), b.NE.String())
+}
+
+// Contains returns whether ll lies within the bounds.
+func (b Bounds) Contains(ll geo.LatLng) bool {
+	return ll.Lat >= b.SW.Lat && ll.Lat <= b.NE.Lat && ll.Lng >= b.SW.Lng && ll.Lng <= b.NE.Lng
+}
+
+// Center returns the midpoint of the bounds.
+func (b Bounds) Center() geo.LatLng {
+	return geo.LatLng{Lat: (b.SW.Lat + b.NE.Lat) / 2, Lng: (b.SW.Lng + b.NE.Lng) / 2}
+}
+
+// Corners returns the four corners of the bounds.
+func (b Bounds) Corners() []geo.LatLng {
+	return []geo.LatLng{
+		b.SW,
+		{Lat: b.SW.Lat, Lng: b.NE.Lng},
+		b.NE,
+		{Lat: b.NE.Lat, Lng: b.SW.Lng},
+	}
+}
+
+// Split divides the bounds into quadrants.
+func (b Bounds) Split() []Bounds {
+	c := b.Center()
+	return []Bounds{
+		{SW: b.SW, NE: c},
+		{SW: geo.LatLng{Lat: b.SW.Lat, Lng: c.Lng}, NE: geo.LatLng{Lat: c.Lat, Lng: b.NE.Lng}},
+		{SW: c, NE: b.NE},
+		{SW: geo.LatLng{Lat: c.Lat, Lng: b.SW.Lng}, NE: geo.LatLng{Lat: b.NE.Lat, Lng: c.Lng}},
+	}
+}
+
+// Tile divides the bounds into tiles which are at most size meters on a side.
+// size must be positive.
+func (b Bounds) Tile(size float64) []Bounds {
+	height := geo.Distance(b.SW, geo.LatLng{Lat: b.NE.Lat, Lng: b.SW.Lng})
+	// Use the widest edge, which is the one closest to the equator.
+	width := math.Max(
+		geo.Distance(b.SW, geo.LatLng{Lat: b.SW.Lat, Lng: b.NE.Lng}),
+		geo.Distance(geo.LatLng{Lat: b.NE.Lat, Lng: b.SW.Lng}, b.NE))
+
+	rows := int(math.Max(1, math.Ceil(height/size)))
+	cols := int(math.Max(1, math.Ceil(width/size)))
+	dlat := (b.NE.Lat - b.SW.Lat) / float64(rows)
+	dlng := (b.NE.Lng - b.SW.Lng) / float64(cols)
+
+	var tiles []Bounds
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			sw := geo.LatLng{Lat: b.SW.Lat + float64(r)*dlat, Lng: b.SW.Lng + float64(c)*dlng}
+			tiles = append(tiles, Bounds{SW: sw, NE: geo.LatLng{Lat: sw.Lat + dlat, Lng: sw.Lng + dlng}})
+		}
+	}
+	return tiles
+}
+
+// BoundingBox returns the smallest Bounds which contain the polygon.
+func BoundingBox(polygon []geo.LatLng) Bounds {
+	b := Bounds{
+		SW: geo.LatLng{Lat: math.Inf(1), Lng: math.Inf(1)},
+		NE: geo.LatLng{Lat: math.Inf(-1), Lng: math.Inf(-1)},
+	}
+	for _, ll := range polygon {
+		b.SW.Lat, b.SW.Lng = math.Min(b.SW.Lat, ll.Lat), math.Min(b.SW.Lng, ll.Lng)
+		b.NE.Lat, b.NE.Lng = math.Max(b.NE.Lat, ll.Lat), math.Max(b.NE.Lng, ll.Lng)
+	}
+	return b
+}
+
+// InPolygon returns whether ll lies within the polygon using ray casting.
+func InPolygon(ll geo.LatLng, polygon []geo.LatLng) bool {
+	in := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > ll.Lat) != (b.Lat > ll.Lat) &&
+			ll.Lng < (b.Lng-a.Lng)*(ll.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			in = !in
+		}
+	}
+	return in
+}
+
+// TilePolygon divides the bounding box of the polygon into tiles which are at
+// most size meters on a side, keeping only those which overlap the polygon.
+// Segments found in the tiles must still be checked against the polygon with
+// InPolygon, eg. by setting DiscoverOptions.Polygon.
+func TilePolygon(polygon []geo.LatLng, size float64) []Bounds {
+	var tiles []Bounds
+	for _, t := range BoundingBox(polygon).Tile(size) {
+		if overlaps(t, polygon) {
+			tiles = append(tiles, t)
+		}
+	}
+	return tiles
+}
+
+func overlaps(t Bounds, polygon []geo.LatLng) bool {
+	if InPolygon(t.Center(), polygon) {
+		return true
+	}
+	for _, c := range t.Corners() {
+		if InPolygon(c, polygon) {
+			return true
+		}
+	}
+	for _, ll := range polygon {
+		if t.Contains(ll) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPolygon reads a polygon from a JSON file of '{"lat": ..., "lng": ...}'
+// points.
+func GetPolygon(file string) ([]geo.LatLng, error) {
+	var polygon []geo.LatLng
+
+	f, err := ioutil.ReadFile(Resource(file))
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(f, &polygon)
+	if err != nil {
+		return nil, err
+	}
+	if len(polygon) < 3 {
+		return nil, fmt.Errorf("polygon must have at least 3 points but had %d", len(polygon))
+	}
+
+	return polygon, nil
+}
+
+// Explorer finds up to EXPLORE_LIMIT segments within the bounds whose climb
+// category is between minCat and maxCat inclusive.
+type Explorer interface {
+	Explore(b Bounds, minCat, maxCat int) ([]strava.ExplorerSegment, error)
+}
+
+type stravaExplorer struct {
+	ctx    *context.Context
+	client *strava.APIClient
+}
+
+// NewStravaExplorer returns an Explorer which uses Strava's explore endpoint.
+func NewStravaExplorer(tokens ...string) (Explorer, error) {
+	ctx, err := GetStravaContext(tokens...)
+	if err != nil {
+		return nil, err
+	}
+	return &stravaExplorer{ctx, strava.NewAPIClient(strava.NewConfiguration())}, nil
+}
+
+func (e *stravaExplorer) Explore(b Bounds, minCat, maxCat int) ([]strava.ExplorerSegment, error) {
+	bounds := []float32{float32(b.SW.Lat), float32(b.SW.Lng), float32(b.NE.Lat), float32(b.NE.Lng)}
+	r, _, err := e.client.SegmentsApi.ExploreSegments(
+		*e.ctx, bounds, map[string]interface{}{
+			"activityType": "riding",
+			"minCat":       int32(minCat),
+			"maxCat":       int32(maxCat),
+		})
+	if err != nil {
+		return nil, err
+	}
+	return r.Segments, nil
+}
+
+// LocalExplorer is an Explorer over a fixed set of segments which mimics the
+// behaviour of Strava's endpoint, eg. for developing offline.
+type LocalExplorer []strava.ExplorerSegment
+
+// GetLocalExplorer reads a LocalExplorer from a JSON file of explorer segments.
+func GetLocalExplorer(file string) (LocalExplorer, error) {
+	var segments LocalExplorer
+
+	f, err := ioutil.ReadFile(Resource(file))
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(f, &segments)
+	if err != nil {
+		return nil, err
+	}
+
+	return segments, nil
+}
+
+func (e LocalExplorer) Explore(b Bounds, minCat, maxCat int) ([]strava.ExplorerSegment, error) {
+	var segments []strava.ExplorerSegment
+	for _, s := range e {
+		if s.StartLatlng == nil {
+			continue
+		}
+		start := geo.LatLng{Lat: s.StartLatlng[0], Lng: s.StartLatlng[1]}
+		cat := int(s.ClimbCategory)
+		if b.Contains(start) && cat >= minCat && cat <= maxCat {
+			segments = append(segments, s)
+			if len(segments) == EXPLORE_LIMIT {
+				break
+			}
+		}
+	}
+	return segments, nil
+}
+
+// DiscoverOptions determines which segments are returned by Discover.
+type DiscoverOptions struct {
+	MinCategory int
+	MaxCategory int
+	// Minimum distance in meters.
+	MinDistance float64
+	// Minimum average grade as a fraction, eg. 0.05.
+	MinGrade float64
+	// Minimum elevation gain in meters.
+	MinGain float64
+	// Polygon, if set, is the region segments must start within. Tiles on the
+	// edge of the polygon extend beyond it.
+	Polygon []geo.LatLng
+	// MaxDepth is the number of times a tile which returned EXPLORE_LIMIT
+	// segments will be split to look for segments beyond the limit.
+	MaxDepth int
+}
+
+// Discover explores each of the tiles and returns the distinct segments which
+// satisfy the options, sorted by decreasing elevation gain.
+func Discover(e Explorer, tiles []Bounds, opts DiscoverOptions) ([]strava.ExplorerSegment, error) {
+	seen := make(map[int64]bool)
+	var segments []strava.ExplorerSegment
+
+	var explore func(b Bounds, depth int) error
+	explore = func(b Bounds, depth int) error {
+		ss, err := e.Explore(b, opts.MinCategory, opts.MaxCategory)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range ss {
+			if seen[s.Id] {
+				continue
+			}
+			seen[s.Id] = true
+
+			if float64(s.Distance) < opts.MinDistance ||
+				float64(s.AvgGrade)/100 < opts.MinGrade ||
+				float64(s.ElevDifference) < opts.MinGain {
+				continue
+			}
+			if len(opts.Polygon) > 0 &&
+				(s.StartLatlng == nil || !InPolygon(geo.LatLng{Lat: s.StartLatlng[0], Lng: s.StartLatlng[1]}, opts.Polygon)) {
+				continue
+			}
+			segments = append(segments, s)
+		}
+
+		// Strava only returns the top results, so there may be more to find.
+		if len(ss) >= EXPLORE_LIMIT && depth < opts.MaxDepth {
+			for _, q := range b.Split() {
+				err := explore(q, depth+1)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	for _, t := range tiles {
+		err := explore(t, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(segments, func(i, j int) bool {
+		return segments[i].ElevDifference > segments[j].ElevDifference
+	})
+	return segments, nil
+}
+
+// ExplorerSegmentToSegment returns the Segment described by the summary
+// information returned when exploring. Fields which require the detailed
+// segment (eg. elevations and the map) are left unset.
+func ExplorerSegmentToSegment(s *strava.ExplorerSegment) (*Segment, error) {
+	lls, err := geo.DecodePolyline(s.Points)
+	if err != nil {
+		return nil, err
+	}
+
+	segment := &Segment{
+		ID:                 s.Id,
+		Name:               s.Name,
+		Distance:           float64(s.Distance),
+		AverageGrade:       float64(s.AvgGrade) / 100,
+		TotalElevationGain: float64(s.ElevDifference),
+	}
+	if s.StartLatlng != nil {
+		segment.StartLocation = geo.LatLng{Lat: s.StartLatlng[0], Lng: s.StartLatlng[1]}
+	}
+	if s.EndLatlng != nil {
+		segment.EndLocation = geo.LatLng{Lat: s.EndLatlng[0], Lng: s.EndLatlng[1]}
+	}
+	if len(lls) > 0 {
+		segment.AverageLocation = geo.Average(lls)
+		segment.AverageDirection = geo.AverageDirection(lls)
+	}
+	return segment, nil
+}
@@ -0,0 +1,173 @@
+package stravutils
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/scheibo/geo"
+	"github.com/scheibo/strava"
+)
+
+func explorerSegment(id int64, lat, lng float64) strava.ExplorerSegment {
+	return strava.ExplorerSegment{
+		Id:             id,
+		ClimbCategory:  3,
+		AvgGrade:       6,
+		StartLatlng:    &strava.LatLng{lat, lng},
+		ElevDifference: 120,
+		Distance:       2000,
+	}
+}
+
+func ids(segments []strava.ExplorerSegment) []int64 {
+	var ids []int64
+	for _, s := range segments {
+		ids = append(ids, s.Id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTile(t *testing.T) {
+	b := Bounds{SW: geo.LatLng{Lat: 37.0, Lng: -122.0}, NE: geo.LatLng{Lat: 37.1, Lng: -121.9}}
+
+	tiles := b.Tile(5000)
+	// ~11.1km tall and ~8.9km wide.
+	if len(tiles) != 6 {
+		t.Fatalf("got %d tiles, want 6", len(tiles))
+	}
+	for _, tile := range tiles {
+		height := geo.Distance(tile.SW, geo.LatLng{Lat: tile.NE.Lat, Lng: tile.SW.Lng})
+		width := geo.Distance(tile.SW, geo.LatLng{Lat: tile.SW.Lat, Lng: tile.NE.Lng})
+		if height > 5000 || width > 5000 {
+			t.Errorf("tile %s is %.0fm x %.0fm, want at most 5000m", tile, width, height)
+		}
+	}
+	if tiles[0].SW != b.SW {
+		t.Errorf("first tile starts at %v, want %v", tiles[0].SW, b.SW)
+	}
+	last := tiles[len(tiles)-1].NE
+	if !(geo.Distance(last, b.NE) < 1) {
+		t.Errorf("last tile ends at %v, want %v", last, b.NE)
+	}
+
+	if n := len(b.Tile(100000)); n != 1 {
+		t.Errorf("got %d tiles larger than the bounds, want 1", n)
+	}
+}
+
+func TestTilePolygon(t *testing.T) {
+	triangle := []geo.LatLng{{Lat: 37.0, Lng: -122.0}, {Lat: 37.0, Lng: -121.9}, {Lat: 37.1, Lng: -122.0}}
+
+	tiles := TilePolygon(triangle, 5000)
+	if len(tiles) != 5 {
+		t.Fatalf("got %d tiles, want 5", len(tiles))
+	}
+	// Only the north east tile lies entirely outside of the triangle.
+	for _, tile := range tiles {
+		if tile.NE == (geo.LatLng{Lat: 37.1, Lng: -121.9}) {
+			t.Errorf("got tile %s outside of the polygon", tile)
+		}
+	}
+}
+
+func TestDiscoverDedupe(t *testing.T) {
+	tiles := []Bounds{
+		{SW: geo.LatLng{Lat: 0, Lng: 0}, NE: geo.LatLng{Lat: 1, Lng: 1}},
+		{SW: geo.LatLng{Lat: 0, Lng: 1}, NE: geo.LatLng{Lat: 1, Lng: 2}},
+	}
+	// The first segment is on the edge shared by both tiles.
+	e := LocalExplorer{explorerSegment(1, 0.5, 1), explorerSegment(2, 0.5, 0.5), explorerSegment(3, 0.5, 1.5)}
+
+	segments, err := Discover(e, tiles, DiscoverOptions{MaxCategory: MAX_CATEGORY})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(segments), []int64{1, 2, 3}; !equalIDs(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDiscoverSplit(t *testing.T) {
+	tiles := []Bounds{{SW: geo.LatLng{Lat: 0, Lng: 0}, NE: geo.LatLng{Lat: 1, Lng: 1}}}
+
+	// More segments than the explore limit, spread across the quadrants.
+	var e LocalExplorer
+	var all []int64
+	for i := 0; i < EXPLORE_LIMIT+5; i++ {
+		lat := 0.25 + 0.5*float64(i%2) + 0.01*float64(i/4)
+		lng := 0.25 + 0.5*float64(i/2%2)
+		e = append(e, explorerSegment(int64(i+1), lat, lng))
+		all = append(all, int64(i+1))
+	}
+
+	tests := []struct {
+		depth int
+		want  int
+	}{
+		{0, EXPLORE_LIMIT},
+		{1, len(all)},
+	}
+	for _, tt := range tests {
+		segments, err := Discover(e, tiles, DiscoverOptions{MaxCategory: MAX_CATEGORY, MaxDepth: tt.depth})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) != tt.want {
+			t.Errorf("depth %d: got %d segments, want %d", tt.depth, len(segments), tt.want)
+		}
+	}
+}
+
+func TestDiscoverFilters(t *testing.T) {
+	tiles := []Bounds{{SW: geo.LatLng{Lat: 37.0, Lng: -122.0}, NE: geo.LatLng{Lat: 37.1, Lng: -121.9}}}
+	triangle := []geo.LatLng{{Lat: 37.0, Lng: -122.0}, {Lat: 37.0, Lng: -121.9}, {Lat: 37.1, Lng: -122.0}}
+
+	ok := explorerSegment(1, 37.02, -121.98)
+	higher := explorerSegment(2, 37.03, -121.97)
+	higher.ElevDifference = 300
+	uncategorized := explorerSegment(3, 37.02, -121.98)
+	uncategorized.ClimbCategory = 0
+	short := explorerSegment(4, 37.02, -121.98)
+	short.Distance = 500
+	flat := explorerSegment(5, 37.02, -121.98)
+	flat.AvgGrade = 2
+	low := explorerSegment(6, 37.02, -121.98)
+	low.ElevDifference = 20
+	// Within the bounds but outside of the triangle.
+	outside := explorerSegment(7, 37.09, -121.91)
+	e := LocalExplorer{ok, higher, uncategorized, short, flat, low, outside}
+
+	opts := DiscoverOptions{MinCategory: 1, MaxCategory: MAX_CATEGORY, MinDistance: 1000, MinGrade: 0.03, MinGain: 50}
+	segments, err := Discover(e, tiles, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(segments), []int64{1, 2, 7}; !equalIDs(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if segments[0].Id != 2 {
+		t.Errorf("got %d first, want the segment with the most elevation gain", segments[0].Id)
+	}
+
+	opts.Polygon = triangle
+	segments, err = Discover(e, tiles, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(segments), []int64{1, 2}; !equalIDs(got, want) {
+		t.Errorf("with polygon: got %v, want %v", got, want)
+	}
+}
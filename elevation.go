@@ -0,0 +1,312 @@
+package stravutils
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/scheibo/geo"
+)
+
+// The filters which can be used to smooth an elevation profile.
+const (
+	FILTER_NONE     = "none"
+	FILTER_MEAN     = "mean"
+	FILTER_MEDIAN   = "median"
+	FILTER_GAUSSIAN = "gaussian"
+)
+
+// CleanOptions control how an elevation profile is cleaned. The zero value of
+// each option disables the corresponding step.
+type CleanOptions struct {
+	// Steps steeper than MaxGrade which are undone by an opposite step within
+	// SpikeWidth meters are considered spikes and interpolated over.
+	MaxGrade   float64
+	SpikeWidth float64
+	// Filter is applied over a window of Window meters centered on each point.
+	Filter string
+	Window float64
+	// Spacing in meters to resample the points to.
+	Spacing float64
+	// Reconcile rescales elevations to Strava's ElevationLow and ElevationHigh.
+	Reconcile bool
+}
+
+// ElevationStats summarize an elevation profile.
+type ElevationStats struct {
+	Points   int     `json:"points"`
+	Distance float64 `json:"distance"`
+	Low      float64 `json:"elevation_low"`
+	High     float64 `json:"elevation_high"`
+	// Gain is the sum of every rise, whereas Grade is the net rise over the
+	// distance.
+	Gain     float64 `json:"total_elevation_gain"`
+	Grade    float64 `json:"average_grade"`
+	MaxGrade float64 `json:"max_grade"`
+	Spikes   int     `json:"spikes"`
+}
+
+// CleanResult is the result of cleaning a segment's elevation profile.
+type CleanResult struct {
+	Before ElevationStats `json:"before"`
+	After  ElevationStats `json:"after"`
+	Map    string         `json:"map"`
+}
+
+// CleanSegment cleans the elevation profile of the segment's map, returning
+// the stats before and after and the corrected map.
+func CleanSegment(s *Segment, opts CleanOptions) (*CleanResult, error) {
+	if s.Map == "" {
+		return nil, fmt.Errorf("segment %d has no map", s.ID)
+	}
+	lles, err := geo.DecodeZPolyline(s.Map)
+	if err != nil {
+		return nil, err
+	}
+	if len(lles) < 2 {
+		return nil, fmt.Errorf("segment %d has too few points", s.ID)
+	}
+
+	cleaned := CleanElevation(lles, s, opts)
+	return &CleanResult{
+		Before: ProfileStats(lles, opts),
+		After:  ProfileStats(cleaned, opts),
+		Map:    encodeZPolyline(cleaned),
+	}, nil
+}
+
+// CleanElevation removes spikes from, smooths, resamples and reconciles the
+// elevations of lles according to opts. s is only required for reconciling.
+func CleanElevation(lles []geo.LatLngEle, s *Segment, opts CleanOptions) []geo.LatLngEle {
+	lles = append([]geo.LatLngEle(nil), lles...)
+	d := distances(lles)
+
+	if opts.MaxGrade > 0 {
+		RemoveSpikes(lles, d, opts.MaxGrade, opts.SpikeWidth)
+	}
+	if opts.Window > 0 && opts.Filter != "" && opts.Filter != FILTER_NONE {
+		lles = Smooth(lles, d, opts.Filter, opts.Window)
+	}
+	if opts.Spacing > 0 {
+		lles = Resample(lles, d, opts.Spacing)
+	}
+	if opts.Reconcile && s != nil {
+		Reconcile(lles, s.ElevationLow, s.ElevationHigh)
+	}
+	return lles
+}
+
+// ProfileStats computes ElevationStats for lles, counting spikes as defined by
+// opts.
+func ProfileStats(lles []geo.LatLngEle, opts CleanOptions) ElevationStats {
+	st := ElevationStats{Points: len(lles)}
+	if len(lles) == 0 {
+		return st
+	}
+
+	d := distances(lles)
+	st.Distance = d[len(d)-1]
+	st.Low, st.High = lles[0].Ele, lles[0].Ele
+	for i := 1; i < len(lles); i++ {
+		rise := lles[i].Ele - lles[i-1].Ele
+		if rise > 0 {
+			st.Gain += rise
+		}
+		if run := d[i] - d[i-1]; run > 0 {
+			st.MaxGrade = math.Max(st.MaxGrade, rise/run)
+		}
+		st.Low = math.Min(st.Low, lles[i].Ele)
+		st.High = math.Max(st.High, lles[i].Ele)
+	}
+	if st.Distance > 0 {
+		st.Grade = (lles[len(lles)-1].Ele - lles[0].Ele) / st.Distance
+	}
+	if opts.MaxGrade > 0 {
+		st.Spikes = len(spikes(lles, d, opts.MaxGrade, opts.SpikeWidth))
+	}
+	return st
+}
+
+// RemoveSpikes interpolates over each spike in lles, where d is the distance
+// of each point from the start. A spike is a step steeper than maxGrade which
+// is undone by a step in the opposite direction within width meters.
+func RemoveSpikes(lles []geo.LatLngEle, d []float64, maxGrade, width float64) int {
+	found := spikes(lles, d, maxGrade, width)
+	for _, s := range found {
+		// Points in [i, j) are interpolated between i-1 and j.
+		i, j := s[0], s[1]
+		a, b := lles[i-1], lles[j]
+		for k := i; k < j; k++ {
+			f := 0.0
+			if d[j] > d[i-1] {
+				f = (d[k] - d[i-1]) / (d[j] - d[i-1])
+			}
+			lles[k].Ele = a.Ele + f*(b.Ele-a.Ele)
+		}
+	}
+	return len(found)
+}
+
+func spikes(lles []geo.LatLngEle, d []float64, maxGrade, width float64) [][2]int {
+	var found [][2]int
+	for i := 1; i < len(lles); i++ {
+		g := grade(lles, d, i)
+		if math.Abs(g) <= maxGrade {
+			continue
+		}
+		for j := i + 1; j < len(lles) && d[j-1]-d[i] <= width; j++ {
+			h := grade(lles, d, j)
+			if math.Abs(h) > maxGrade && math.Signbit(g) != math.Signbit(h) {
+				found = append(found, [2]int{i, j})
+				i = j
+				break
+			}
+		}
+	}
+	return found
+}
+
+// grade returns the grade of the step ending at point i.
+func grade(lles []geo.LatLngEle, d []float64, i int) float64 {
+	run := d[i] - d[i-1]
+	if run <= 0 {
+		return 0
+	}
+	return (lles[i].Ele - lles[i-1].Ele) / run
+}
+
+// Smooth applies the filter over a window of the given width in meters
+// centered on each point of lles, where d is the distance of each point from
+// the start. The first and last points are left unchanged.
+func Smooth(lles []geo.LatLngEle, d []float64, filter string, window float64) []geo.LatLngEle {
+	smoothed := append([]geo.LatLngEle(nil), lles...)
+	half := window / 2
+	// The Gaussian kernel's standard deviation is chosen such that the window
+	// covers two standard deviations either side.
+	sigma := window / 4
+
+	lo := 0
+	for i := 1; i < len(lles)-1; i++ {
+		for d[i]-d[lo] > half {
+			lo++
+		}
+		hi := i
+		for hi+1 < len(lles) && d[hi+1]-d[i] <= half {
+			hi++
+		}
+
+		switch filter {
+		case FILTER_MEAN:
+			sum := 0.0
+			for k := lo; k <= hi; k++ {
+				sum += lles[k].Ele
+			}
+			smoothed[i].Ele = sum / float64(hi-lo+1)
+		case FILTER_MEDIAN:
+			eles := make([]float64, 0, hi-lo+1)
+			for k := lo; k <= hi; k++ {
+				eles = append(eles, lles[k].Ele)
+			}
+			smoothed[i].Ele = median(eles)
+		case FILTER_GAUSSIAN:
+			sum, weights := 0.0, 0.0
+			for k := lo; k <= hi; k++ {
+				x := (d[k] - d[i]) / sigma
+				w := math.Exp(-x * x / 2)
+				sum += w * lles[k].Ele
+				weights += w
+			}
+			smoothed[i].Ele = sum / weights
+		}
+	}
+	return smoothed
+}
+
+// Resample returns points every spacing meters along lles, where d is the
+// distance of each point from the start. The last point is always included.
+func Resample(lles []geo.LatLngEle, d []float64, spacing float64) []geo.LatLngEle {
+	if len(lles) < 2 {
+		return lles
+	}
+
+	total := d[len(d)-1]
+	resampled := []geo.LatLngEle{lles[0]}
+	j := 1
+	for x := spacing; x < total; x += spacing {
+		for d[j] < x {
+			j++
+		}
+		a, b := lles[j-1], lles[j]
+		f := 0.0
+		if d[j] > d[j-1] {
+			f = (x - d[j-1]) / (d[j] - d[j-1])
+		}
+		resampled = append(resampled, geo.LatLngEle{
+			Lat: a.Lat + f*(b.Lat-a.Lat),
+			Lng: a.Lng + f*(b.Lng-a.Lng),
+			Ele: a.Ele + f*(b.Ele-a.Ele),
+		})
+	}
+	return append(resampled, lles[len(lles)-1])
+}
+
+// Reconcile linearly rescales the elevations of lles such that their range
+// matches low and high. Nothing is done if either range is empty.
+func Reconcile(lles []geo.LatLngEle, low, high float64) {
+	if len(lles) == 0 || high <= low {
+		return
+	}
+
+	lo, hi := lles[0].Ele, lles[0].Ele
+	for _, lle := range lles {
+		lo = math.Min(lo, lle.Ele)
+		hi = math.Max(hi, lle.Ele)
+	}
+	if hi <= lo {
+		return
+	}
+
+	scale := (high - low) / (hi - lo)
+	for i := range lles {
+		lles[i].Ele = low + (lles[i].Ele-lo)*scale
+	}
+}
+
+// distances returns the cumulative distance in meters of each point from the
+// start of lles.
+func distances(lles []geo.LatLngEle) []float64 {
+	d := make([]float64, len(lles))
+	for i := 1; i < len(lles); i++ {
+		d[i] = d[i-1] + geo.Distance(lles[i-1].LatLng(), lles[i].LatLng())
+	}
+	return d
+}
+
+func median(vs []float64) float64 {
+	sort.Float64s(vs)
+	n := len(vs)
+	if n%2 == 1 {
+		return vs[n/2]
+	}
+	return (vs[n/2-1] + vs[n/2]) / 2
+}
+
+// encodeZPolyline encodes lles, rounding rather than truncating to the
+// polyline's precision so that values which have been decoded round trip.
+func encodeZPolyline(lles []geo.LatLngEle) string {
+	rounded := make([]geo.LatLngEle, len(lles))
+	for i, lle := range lles {
+		rounded[i] = geo.LatLngEle{Lat: round5(lle.Lat), Lng: round5(lle.Lng), Ele: round5(lle.Ele)}
+	}
+	return geo.EncodeZPolyline(rounded)
+}
+
+// round5 rounds x to 5 decimal places, nudged away from zero by half a unit
+// so that truncation in the encoder yields the rounded value.
+func round5(x float64) float64 {
+	r := math.Round(x * 1e5)
+	if r < 0 {
+		return (r - 0.5) / 1e5
+	}
+	return (r + 0.5) / 1e5
+}
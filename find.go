@@ -0,0 +1,82 @@
+package stravutils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/scheibo/fuzzy"
+)
+
+const MATCH_THRESHOLD = 0.6
+
+// MAX_CANDIDATES is the number of candidates suggested when a segment can't be
+// found decisively.
+const MAX_CANDIDATES = 5
+
+var alphanum = regexp.MustCompile("[^a-zA-Z0-9]+")
+
+// FindSegment resolves args to a segment, either by ID, by searching the names
+// and aliases of climbs or, if args is empty, interactively via fzf. If the
+// search is not decisive an *AmbiguousError with the candidates is returned.
+func FindSegment(climbs []Climb, args []string, tokens ...string) (*Segment, error) {
+	argc := len(args)
+	if argc == 1 {
+		id, err := strconv.ParseInt(args[0], 10, 0)
+		if err == nil {
+			return GetSegmentByID(id, climbs, tokens...)
+		}
+	}
+
+	if argc == 0 {
+		var names []string
+		namedClimbs := make(map[string]Climb)
+		for _, c := range climbs {
+			names = append(names, c.Name, c.Segment.Name)
+			namedClimbs[c.Name] = c
+			namedClimbs[c.Segment.Name] = c
+			for _, alias := range c.Aliases {
+				names = append(names, alias)
+				namedClimbs[alias] = c
+			}
+		}
+
+		m, err := fuzzy.FzfMatch(names)
+		if err != nil {
+			return nil, fmt.Errorf("could not find a segment: %s", err)
+		}
+		c, ok := namedClimbs[m]
+		if !ok {
+			return nil, fmt.Errorf("could not find a segment matching: %s", m)
+		}
+		return &c.Segment, nil
+	}
+
+	return NewSearchIndex(climbs).Find(strings.Join(args, " "))
+}
+
+// Find returns the segment of the climb decisively matching the query, or an
+// *AmbiguousError with the candidates if the search is not decisive.
+func (idx *SearchIndex) Find(query string) (*Segment, error) {
+	results := idx.Search(query, MAX_CANDIDATES)
+	if Decisive(results) {
+		return &results[0].Climb.Segment, nil
+	}
+
+	var candidates []SearchResult
+	for _, r := range results {
+		if r.Score >= MATCH_THRESHOLD {
+			candidates = append(candidates, r)
+		}
+	}
+	return nil, &AmbiguousError{Query: query, Candidates: candidates}
+}
+
+func simplify(name string, a bool) string {
+	if a {
+		return strings.ToLower(alphanum.ReplaceAllString(name, ""))
+	} else {
+		return name
+	}
+}
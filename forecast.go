@@ -0,0 +1,196 @@
+package stravutils
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/scheibo/geo"
+	"github.com/scheibo/weather"
+)
+
+// ForecastConditions returns the forecasted conditions at ll for the hour
+// containing t.
+func ForecastConditions(w *weather.Client, ll geo.LatLng, t time.Time) (*weather.Conditions, error) {
+	f, err := w.Forecast(ll)
+	if err != nil {
+		return nil, err
+	}
+
+	t = t.Truncate(time.Hour)
+	for _, h := range f.Hourly {
+		if h.Time.Truncate(time.Hour).Equal(t) {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("no forecast available for %s", t)
+}
+
+// Conditions returns the forecasted conditions at ll for t if t is in the
+// future and the historical conditions otherwise.
+func (w *Weather) Conditions(ll geo.LatLng, t time.Time) (*weather.Conditions, error) {
+	if t.After(time.Now()) {
+		if w.offline {
+			return nil, fmt.Errorf("forecasts are not available in offline mode")
+		}
+		return ForecastConditions(w.client(), ll, t)
+	}
+	return w.HistoricalConditions(ll, t)
+}
+
+// Forecast returns the hourly forecast at ll.
+func (w *Weather) Forecast(ll geo.LatLng) (*weather.Forecast, error) {
+	if w.offline {
+		return nil, fmt.Errorf("forecasts are not available in offline mode")
+	}
+	return w.client().Forecast(ll)
+}
+
+// Current returns the current conditions at ll.
+func (w *Weather) Current(ll geo.LatLng) (*weather.Conditions, error) {
+	if w.offline {
+		return nil, fmt.Errorf("current conditions are not available in offline mode")
+	}
+	return w.client().Current(ll)
+}
+
+func (w *Weather) client() *weather.Client {
+	return weather.NewClient(weather.DarkSky(w.key), weather.TimeZone(w.loc))
+}
+
+// WindowOptions control which hours of a forecast are considered by
+// BestWindows and how they are ranked.
+type WindowOptions struct {
+	// Days from now to consider.
+	Days int
+	// Hours [0-23] of each day to consider.
+	MinHour, MaxHour int
+	// Daylight restricts windows to hours starting between sunrise and sunset.
+	Daylight bool
+	// Historical ranks windows by the historical instead of baseline WNF.
+	Historical bool
+}
+
+// Window is an hour of forecasted conditions for a segment along with its
+// wind normalization factors.
+type Window struct {
+	Segment       *Segment            `json:"segment"`
+	Time          time.Time           `json:"time"`
+	Conditions    *weather.Conditions `json:"conditions"`
+	WNF           float64             `json:"wnf"`
+	HistoricalWNF float64             `json:"historical_wnf,omitempty"`
+}
+
+// Windows scores each hour of the forecast f for the segment which satisfies
+// opts. Historical averages are optional unless ranking by them.
+func Windows(s *Segment, f *weather.Forecast, avgs HistoricalClimbAverages, opts WindowOptions, loc *time.Location) ([]Window, error) {
+	var windows []Window
+	if len(f.Hourly) == 0 {
+		return windows, nil
+	}
+
+	// Hours in progress are not considered.
+	start := time.Now().Truncate(time.Hour).Add(time.Hour)
+	end := start.Add(time.Duration(opts.Days) * 24 * time.Hour)
+	for _, c := range f.Hourly {
+		t := c.Time.In(loc)
+		if t.Before(start) || (opts.Days > 0 && !t.Before(end)) {
+			continue
+		}
+		if hour := t.Hour(); hour < opts.MinHour || hour > opts.MaxHour {
+			continue
+		}
+		if opts.Daylight && !c.SunriseTime.IsZero() &&
+			(t.Before(c.SunriseTime) || !t.Before(c.SunsetTime)) {
+			continue
+		}
+
+		var past *weather.Conditions
+		if avgs != nil {
+			past = avgs.Get(s, t, loc)
+		}
+		if opts.Historical && past == nil {
+			return nil, fmt.Errorf("no historical averages for segment %d", s.ID)
+		}
+
+		baseline, historical, err := WNF(s, c, past)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, Window{
+			Segment:       s,
+			Time:          t,
+			Conditions:    c,
+			WNF:           baseline,
+			HistoricalWNF: historical,
+		})
+	}
+	return windows, nil
+}
+
+// SortWindows sorts windows from best to worst, ie. by ascending WNF.
+func SortWindows(windows []Window, historical bool) {
+	score := func(w Window) float64 {
+		if historical {
+			return w.HistoricalWNF
+		}
+		return w.WNF
+	}
+	sort.SliceStable(windows, func(i, j int) bool {
+		return score(windows[i]) < score(windows[j])
+	})
+}
+
+// ScoreSegments computes the conditions at t and the WNF scores for each of
+// the segments, querying for up to parallel segments at once. Historical
+// averages are optional unless historical is set, in which case every segment
+// must have them. The windows are returned in the order of segments.
+func (w *Weather) ScoreSegments(segments []*Segment, t time.Time, avgs HistoricalClimbAverages, historical bool, parallel int, loc *time.Location) ([]Window, error) {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	windows := make([]Window, len(segments))
+	errs := make([]error, len(segments))
+	sem := make(chan struct{}, parallel)
+
+	var wg sync.WaitGroup
+	for i, s := range segments {
+		wg.Add(1)
+		go func(i int, s *Segment) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			c, err := w.Conditions(s.AverageLocation, t)
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %s", s.Name, err)
+				return
+			}
+
+			var past *weather.Conditions
+			if avgs != nil {
+				past = avgs.Get(s, t, loc)
+			}
+			if historical && past == nil {
+				errs[i] = fmt.Errorf("no historical averages for segment %d", s.ID)
+				return
+			}
+			baseline, hwnf, err := WNF(s, c, past)
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %s", s.Name, err)
+				return
+			}
+			windows[i] = Window{Segment: s, Time: t, Conditions: c, WNF: baseline, HistoricalWNF: hwnf}
+		}(i, s)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return windows, nil
+}
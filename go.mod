@@ -3,7 +3,7 @@ module github.com/scheibo/stravutils
 go 1.11
 
 require (
-	github.com/antzucaro/matchr v0.0.0-20221106193745-7bed6ef61ef9 // indirect
+	github.com/antzucaro/matchr v0.0.0-20221106193745-7bed6ef61ef9
 	github.com/araddon/dateparse v0.0.0-20210429162001-6b43995a97de
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/scheibo/calc v0.0.1
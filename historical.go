@@ -20,6 +20,7 @@ import (
 var now = time.Now()
 
 type Weather struct {
+	key      string
 	ds       *darksky.Client
 	cache    string
 	throttle <-chan time.Time
@@ -27,11 +28,22 @@ type Weather struct {
 	offline  bool
 }
 
+// CacheMissError is returned when historical conditions are requested in
+// offline mode which were never cached.
+type CacheMissError struct {
+	Path string
+}
+
+func (e *CacheMissError) Error() string {
+	return fmt.Sprintf("could not find cached results: %s", e.Path)
+}
+
 func NewWeatherClient(key, cache string, qps int, loc *time.Location, offline bool) *Weather {
 	if cache == "" {
 		cache = resource("cache")
 	}
 	return &Weather{
+		key:      key,
 		ds:       darksky.NewClient(key),
 		cache:    cache,
 		throttle: time.Tick(time.Second / time.Duration(qps)),
@@ -52,7 +64,7 @@ func (w *Weather) Historical(ll geo.LatLng, t time.Time) (*weather.Forecast, err
 	}
 
 	if w.offline {
-		return nil, fmt.Errorf("could not find cached results: %s", cache)
+		return nil, &CacheMissError{cache}
 	}
 
 	path := fmt.Sprintf("%s,%s,%d", geo.Coordinate(ll.Lat), geo.Coordinate(ll.Lng), t.Unix())
@@ -80,6 +92,21 @@ func (w *Weather) Historical(ll geo.LatLng, t time.Time) (*weather.Forecast, err
 	return w.toTrimmedForecast(r)
 }
 
+// HistoricalConditions returns the conditions at ll for the hour containing t.
+func (w *Weather) HistoricalConditions(ll geo.LatLng, t time.Time) (*weather.Conditions, error) {
+	f, err := w.Historical(ll, t)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Hourly) != 24 {
+		return nil, fmt.Errorf("forecast is wrong size: want 24, got %d", len(f.Hourly))
+	}
+
+	t = t.In(w.loc)
+	hour, _, _ := t.Clock()
+	return f.Hourly[hour], nil
+}
+
 func (w *Weather) load(path string) (*weather.Forecast, error) {
 	file, err := os.Open(path)
 	if err != nil {
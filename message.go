@@ -0,0 +1,121 @@
+package stravutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/scheibo/weather"
+)
+
+// MESSAGE_VERSION is the version of the Message schema written by commands.
+const MESSAGE_VERSION = 1
+
+// Message is the data passed between commands as lines of JSON on stdin and
+// stdout so that they can be composed, eg. 'strava olh | weather | predict'.
+// Commands fill in what they know and pass along the rest.
+type Message struct {
+	Version    int                 `json:"version"`
+	Segment    *Segment            `json:"segment,omitempty"`
+	Time       *time.Time          `json:"time,omitempty"`
+	Conditions *weather.Conditions `json:"conditions,omitempty"`
+	Rider      *Rider              `json:"rider,omitempty"`
+	// Wind normalization factors for the Segment under the Conditions
+	// relative to still air and the historical average conditions.
+	WNF           float64 `json:"wnf,omitempty"`
+	HistoricalWNF float64 `json:"historical_wnf,omitempty"`
+	// Predicted duration in seconds and power in watts of the Rider's effort.
+	Duration float64 `json:"duration,omitempty"`
+	Power    float64 `json:"power,omitempty"`
+}
+
+// NewMessage returns an empty Message of the current version.
+func NewMessage() *Message {
+	return &Message{Version: MESSAGE_VERSION}
+}
+
+// ReadMessages reads a stream of JSON Messages. For compatibility, bare
+// Segments are also accepted and wrapped in an Message.
+func ReadMessages(r io.Reader) ([]*Message, error) {
+	var messages []*Message
+
+	d := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		err := d.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var fields map[string]json.RawMessage
+		err = json.Unmarshal(raw, &fields)
+		if err != nil {
+			return nil, err
+		}
+
+		e := NewMessage()
+		if _, ok := fields["version"]; ok {
+			err = json.Unmarshal(raw, e)
+			if err != nil {
+				return nil, err
+			}
+			if e.Version < 1 || e.Version > MESSAGE_VERSION {
+				return nil, fmt.Errorf("unsupported message version %d (expected <= %d)", e.Version, MESSAGE_VERSION)
+			}
+		} else if _, ok := fields["id"]; ok {
+			var s Segment
+			err = json.Unmarshal(raw, &s)
+			if err != nil {
+				return nil, err
+			}
+			e.Segment = &s
+		} else {
+			return nil, fmt.Errorf("expected a message or segment")
+		}
+		messages = append(messages, e)
+	}
+
+	return messages, nil
+}
+
+// ParseMessages is ReadMessages for data which has already been read.
+func ParseMessages(b []byte) ([]*Message, error) {
+	return ReadMessages(bytes.NewReader(b))
+}
+
+// Write writes the Message as a single line of JSON.
+func (m *Message) Write(w io.Writer) error {
+	m.Version = MESSAGE_VERSION
+	j, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(j, '\n'))
+	return err
+}
+
+// Flags returns the legacy flag representation of the Message's conditions
+// and segment, eg. '-rho=1.2000 -vw=2.000 -dw=180.00 -db=90.00 -d=1000.00
+// -e=100.00'. The segment's median elevation is only included if there are no
+// conditions, as the air density already accounts for it.
+func (m *Message) Flags() string {
+	var flags []string
+	c, s := m.Conditions, m.Segment
+	if c != nil {
+		flags = append(flags, fmt.Sprintf("-rho=%.4f -vw=%.3f -dw=%.2f", c.AirDensity, c.WindSpeed, c.WindBearing))
+	}
+	if s != nil {
+		if c != nil {
+			flags = append(flags, fmt.Sprintf("-db=%.2f -d=%.2f -e=%.2f", s.AverageDirection, s.Distance, s.TotalElevationGain))
+		} else {
+			flags = append(flags, fmt.Sprintf("-d=%.2f -e=%.2f -h=%.2f", s.Distance, s.TotalElevationGain, s.MedianElevation))
+		}
+	}
+	return strings.Join(flags, " ")
+}
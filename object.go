@@ -0,0 +1,122 @@
+package stravutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Object is a JSON object which preserves the order of its keys and any keys
+// we don't know about so that hand-edited catalogs survive a round trip.
+type Object struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+// NewObject returns an empty Object.
+func NewObject() *Object {
+	return &Object{values: make(map[string]json.RawMessage)}
+}
+
+func (o *Object) UnmarshalJSON(b []byte) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	t, err := d.Token()
+	if err != nil {
+		return err
+	}
+	if t != json.Delim('{') {
+		return fmt.Errorf("expected an object but got %v", t)
+	}
+
+	o.keys = nil
+	o.values = make(map[string]json.RawMessage)
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		k := t.(string)
+		var v json.RawMessage
+		err = d.Decode(&v)
+		if err != nil {
+			return err
+		}
+		o.Set(k, v)
+	}
+	return nil
+}
+
+func (o *Object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		kb, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(kb)
+		buf.WriteByte(':')
+		buf.Write(o.values[k])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Get returns the raw value of the key, if present.
+func (o *Object) Get(k string) (json.RawMessage, bool) {
+	v, ok := o.values[k]
+	return v, ok
+}
+
+// Set sets the raw value of the key, appending it if it is new.
+func (o *Object) Set(k string, v json.RawMessage) {
+	if _, ok := o.values[k]; !ok {
+		o.keys = append(o.keys, k)
+	}
+	o.values[k] = v
+}
+
+// Merge overwrites the keys of o with those of v, leaving any others intact.
+func (o *Object) Merge(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var other Object
+	err = json.Unmarshal(b, &other)
+	if err != nil {
+		return err
+	}
+	for _, k := range other.keys {
+		o.Set(k, other.values[k])
+	}
+	return nil
+}
+
+// ReadObjects reads a catalog file as a list of Objects.
+func ReadObjects(path string) ([]*Object, error) {
+	f, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var objs []*Object
+	err = json.Unmarshal(f, &objs)
+	return objs, err
+}
+
+// WriteFileAtomic writes data to a temporary file and renames it over path so
+// that readers never observe a partially written file.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,388 @@
+package stravutils
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/scheibo/geo"
+)
+
+// MAX_POINTS is the maximum number of points polylines are resampled to
+// before being compared.
+const MAX_POINTS = 200
+
+// OverlapOptions determines when two segments are considered to overlap.
+type OverlapOptions struct {
+	// Tolerance is the distance in meters within which two polylines are
+	// considered to coincide.
+	Tolerance float64
+	// MinOverlap is the minimum fraction of the shorter segment which must
+	// coincide with the longer one.
+	MinOverlap float64
+	// MinLengthRatio is the minimum ratio of the length of the shorter segment
+	// to the longer one.
+	MinLengthRatio float64
+	// MaxFrechet is the maximum discrete Fréchet distance in meters between
+	// two segments which are considered the same regardless of overlap.
+	MaxFrechet float64
+}
+
+// Overlap describes how similar two segments are.
+type Overlap struct {
+	// Fraction of the shorter segment which coincides with the longer one.
+	Ratio float64 `json:"ratio"`
+	// Ratio of the length of the shorter segment to the longer one.
+	LengthRatio float64 `json:"length_ratio"`
+	Hausdorff   float64 `json:"hausdorff"`
+	Frechet     float64 `json:"frechet"`
+}
+
+// Cluster is a set of overlapping climbs, one of which is suggested to be the
+// canonical representation of the rest.
+type Cluster struct {
+	Climbs    []Climb `json:"climbs"`
+	Canonical int     `json:"canonical"`
+}
+
+// Merge returns the canonical climb with the names and aliases of the other
+// climbs in the cluster merged into its aliases.
+func (c *Cluster) Merge() Climb {
+	canonical := c.Climbs[c.Canonical]
+	merged := Climb{Name: canonical.Name, Segment: canonical.Segment}
+
+	seen := map[string]bool{strings.ToLower(canonical.Name): true}
+	alias := func(a string) {
+		if a != "" && !seen[strings.ToLower(a)] {
+			seen[strings.ToLower(a)] = true
+			merged.Aliases = append(merged.Aliases, a)
+		}
+	}
+
+	for _, a := range canonical.Aliases {
+		alias(a)
+	}
+	for i, climb := range c.Climbs {
+		if i == c.Canonical {
+			continue
+		}
+		alias(climb.Name)
+		for _, a := range climb.Aliases {
+			alias(a)
+		}
+	}
+	return merged
+}
+
+// point is a LatLng projected onto a plane in meters.
+type point struct {
+	x, y float64
+}
+
+type path []point
+
+// project performs an equirectangular projection of the polyline around
+// origin, which is accurate enough at the scale of a segment.
+func project(lls []geo.LatLng, origin geo.LatLng) path {
+	k := geo.DEGREES_TO_RADIANS * geo.EARTH_RADIUS
+	c := math.Cos(origin.Lat * geo.DEGREES_TO_RADIANS)
+
+	p := make(path, len(lls))
+	for i, ll := range lls {
+		p[i] = point{(ll.Lng - origin.Lng) * k * c, (ll.Lat - origin.Lat) * k}
+	}
+	return p
+}
+
+func (p point) distance(q point) float64 {
+	return math.Hypot(p.x-q.x, p.y-q.y)
+}
+
+// distanceToSegment returns the distance from p to the line segment ab.
+func (p point) distanceToSegment(a, b point) float64 {
+	dx, dy := b.x-a.x, b.y-a.y
+	l := dx*dx + dy*dy
+	if l == 0 {
+		return p.distance(a)
+	}
+	t := math.Max(0, math.Min(1, ((p.x-a.x)*dx+(p.y-a.y)*dy)/l))
+	return p.distance(point{a.x + t*dx, a.y + t*dy})
+}
+
+func (p path) length() float64 {
+	l := 0.0
+	for i := 1; i < len(p); i++ {
+		l += p[i-1].distance(p[i])
+	}
+	return l
+}
+
+// distanceTo returns the shortest distance from q to the path and the index
+// of the closest line segment.
+func (p path) distanceTo(q point) (float64, int) {
+	if len(p) == 1 {
+		return q.distance(p[0]), 0
+	}
+	min, idx := math.Inf(1), 0
+	for i := 1; i < len(p); i++ {
+		if d := q.distanceToSegment(p[i-1], p[i]); d < min {
+			min, idx = d, i-1
+		}
+	}
+	return min, idx
+}
+
+// resample returns a path with at most n points evenly spaced along p.
+func (p path) resample(n int) path {
+	if len(p) <= n {
+		return p
+	}
+
+	step := p.length() / float64(n-1)
+	r := path{p[0]}
+	need := step
+	for i := 1; i < len(p) && len(r) < n-1; i++ {
+		a, b := p[i-1], p[i]
+		d := a.distance(b)
+		for d >= need && len(r) < n-1 {
+			t := need / d
+			a = point{a.x + t*(b.x-a.x), a.y + t*(b.y-a.y)}
+			r = append(r, a)
+			d -= need
+			need = step
+		}
+		need -= d
+	}
+	return append(r, p[len(p)-1])
+}
+
+// hausdorff returns the directed Hausdorff distance from a to b.
+func hausdorff(a, b path) float64 {
+	max := 0.0
+	for _, q := range a {
+		d, _ := b.distanceTo(q)
+		max = math.Max(max, d)
+	}
+	return max
+}
+
+// frechet returns the discrete Fréchet distance between a and b.
+func frechet(a, b path) float64 {
+	prev, cur := make([]float64, len(b)), make([]float64, len(b))
+	for i := range a {
+		for j := range b {
+			d := a[i].distance(b[j])
+			switch {
+			case i == 0 && j == 0:
+				cur[j] = d
+			case i == 0:
+				cur[j] = math.Max(cur[j-1], d)
+			case j == 0:
+				cur[j] = math.Max(prev[j], d)
+			default:
+				cur[j] = math.Max(math.Min(math.Min(prev[j], prev[j-1]), cur[j-1]), d)
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)-1]
+}
+
+// coverage returns the fraction of the length of a which lies within
+// tolerance of b while travelling in the same direction.
+func coverage(a, b path, tolerance float64) float64 {
+	total, covered := 0.0, 0.0
+	for i := 1; i < len(a); i++ {
+		p, q := a[i-1], a[i]
+		l := p.distance(q)
+		total += l
+
+		d, j := b.distanceTo(point{(p.x + q.x) / 2, (p.y + q.y) / 2})
+		if d > tolerance || len(b) < 2 {
+			continue
+		}
+		u, v := b[j], b[j+1]
+		if (q.x-p.x)*(v.x-u.x)+(q.y-p.y)*(v.y-u.y) > 0 {
+			covered += l
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return covered / total
+}
+
+func segmentLatLngs(s *Segment) ([]geo.LatLng, error) {
+	if s.Map == "" {
+		return []geo.LatLng{s.StartLocation, s.EndLocation}, nil
+	}
+	lles, err := geo.DecodeZPolyline(s.Map)
+	if err != nil {
+		return nil, err
+	}
+	if len(lles) < 2 {
+		return nil, fmt.Errorf("segment %d has too few points", s.ID)
+	}
+	return geo.LatLngs(lles), nil
+}
+
+// CompareSegments computes how much a and b overlap.
+func CompareSegments(a, b *Segment, tolerance float64) (*Overlap, error) {
+	lla, err := segmentLatLngs(a)
+	if err != nil {
+		return nil, err
+	}
+	llb, err := segmentLatLngs(b)
+	if err != nil {
+		return nil, err
+	}
+	return compare(lla, llb, tolerance), nil
+}
+
+func compare(lla, llb []geo.LatLng, tolerance float64) *Overlap {
+	a := project(lla, lla[0]).resample(MAX_POINTS)
+	b := project(llb, lla[0]).resample(MAX_POINTS)
+
+	shorter, longer := a, b
+	if a.length() > b.length() {
+		shorter, longer = b, a
+	}
+	o := &Overlap{
+		Ratio:     coverage(shorter, longer, tolerance),
+		Hausdorff: math.Max(hausdorff(a, b), hausdorff(b, a)),
+		Frechet:   frechet(a, b),
+	}
+	if l := longer.length(); l > 0 {
+		o.LengthRatio = shorter.length() / l
+	}
+	return o
+}
+
+// Overlaps returns whether the overlap satisfies the options.
+func (o *Overlap) Overlaps(opts OverlapOptions) bool {
+	return (o.Ratio >= opts.MinOverlap && o.LengthRatio >= opts.MinLengthRatio) ||
+		o.Frechet <= opts.MaxFrechet
+}
+
+// ClusterClimbs groups climbs whose segments overlap. Climbs for the same
+// segment are always grouped together. Only clusters with more than one climb
+// are returned.
+func ClusterClimbs(climbs []Climb, opts OverlapOptions) ([]Cluster, error) {
+	if len(climbs) == 0 {
+		return nil, nil
+	}
+
+	lls := make([][]geo.LatLng, len(climbs))
+	boxes := make([]Bounds, len(climbs))
+	for i := range climbs {
+		ll, err := segmentLatLngs(&climbs[i].Segment)
+		if err != nil {
+			return nil, err
+		}
+		lls[i] = ll
+		boxes[i] = expand(BoundingBox(ll), opts.Tolerance)
+	}
+
+	parent := make([]int, len(climbs))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	// Keep the scores of each pair so we can pick the canonical climbs.
+	scores := make(map[[2]int]*Overlap)
+	for i := range climbs {
+		for j := i + 1; j < len(climbs); j++ {
+			if climbs[i].Segment.ID == climbs[j].Segment.ID {
+				scores[[2]int{i, j}] = &Overlap{Ratio: 1, LengthRatio: 1}
+				parent[find(i)] = find(j)
+				continue
+			}
+			if !intersects(boxes[i], boxes[j]) {
+				continue
+			}
+			o := compare(lls[i], lls[j], opts.Tolerance)
+			if o.Overlaps(opts) {
+				scores[[2]int{i, j}] = o
+				parent[find(i)] = find(j)
+			}
+		}
+	}
+
+	groups := make(map[int][]int)
+	var roots []int
+	for i := range climbs {
+		r := find(i)
+		if _, ok := groups[r]; !ok {
+			roots = append(roots, r)
+		}
+		groups[r] = append(groups[r], i)
+	}
+
+	var clusters []Cluster
+	for _, r := range roots {
+		members := groups[r]
+		if len(members) < 2 {
+			continue
+		}
+		clusters = append(clusters, cluster(climbs, members, scores))
+	}
+	return clusters, nil
+}
+
+// cluster builds a Cluster from the members, suggesting the climb which
+// overlaps the most with the others as canonical, preferring longer segments
+// to break ties.
+func cluster(climbs []Climb, members []int, scores map[[2]int]*Overlap) Cluster {
+	c := Cluster{}
+	best := math.Inf(-1)
+	for k, i := range members {
+		c.Climbs = append(c.Climbs, climbs[i])
+
+		total := 0.0
+		for _, j := range members {
+			a, b := i, j
+			if a > b {
+				a, b = b, a
+			}
+			if o, ok := scores[[2]int{a, b}]; ok {
+				total += o.Ratio
+			}
+		}
+		if total > best || (total == best && climbs[i].Segment.Distance > climbs[members[c.Canonical]].Segment.Distance) {
+			best, c.Canonical = total, k
+		}
+	}
+	return c
+}
+
+// expand grows the bounds by margin meters in each direction.
+func expand(b Bounds, margin float64) Bounds {
+	dlat := margin / (geo.DEGREES_TO_RADIANS * geo.EARTH_RADIUS)
+	dlng := dlat / math.Max(math.Cos(b.NE.Lat*geo.DEGREES_TO_RADIANS), 1e-6)
+	return Bounds{
+		SW: geo.LatLng{Lat: b.SW.Lat - dlat, Lng: b.SW.Lng - dlng},
+		NE: geo.LatLng{Lat: b.NE.Lat + dlat, Lng: b.NE.Lng + dlng},
+	}
+}
+
+func intersects(a, b Bounds) bool {
+	return a.SW.Lat <= b.NE.Lat && b.SW.Lat <= a.NE.Lat && a.SW.Lng <= b.NE.Lng && b.SW.Lng <= a.NE.Lng
+}
+
+// SortClusters orders clusters by decreasing size and then by name.
+func SortClusters(clusters []Cluster) {
+	sort.SliceStable(clusters, func(i, j int) bool {
+		if len(clusters[i].Climbs) != len(clusters[j].Climbs) {
+			return len(clusters[i].Climbs) > len(clusters[j].Climbs)
+		}
+		return clusters[i].Climbs[clusters[i].Canonical].Name < clusters[j].Climbs[clusters[j].Canonical].Name
+	})
+}
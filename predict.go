@@ -0,0 +1,68 @@
+package stravutils
+
+import (
+	"fmt"
+
+	"github.com/scheibo/calc"
+	"github.com/scheibo/geo"
+	"github.com/scheibo/weather"
+)
+
+// PowerDuration returns the power a rider is able to hold for t seconds.
+type PowerDuration func(t float64) float64
+
+// ReferencePowerDuration returns the PowerDuration for r which passes through
+// the reference effort of power p held for t seconds.
+func (r *Rider) ReferencePowerDuration(p, t float64) PowerDuration {
+	scale := p / r.Cp(t)
+	return func(t float64) float64 {
+		return r.Cp(t) * scale
+	}
+}
+
+// PERFPowerDuration returns the PowerDuration for r performing with PERF score
+// score on s.
+func (r *Rider) PERFPowerDuration(score float64, s *Segment) PowerDuration {
+	return func(t float64) float64 {
+		return r.PERFPower(score, t, s)
+	}
+}
+
+// PredictTime returns the time in seconds r is expected to take to complete s
+// under conditions c (or in still air if c is nil) given the PowerDuration pd.
+func PredictTime(pd PowerDuration, s *Segment, c *weather.Conditions, r *Rider) (float64, error) {
+	// epsilon is some small value that determines when we will stop the search
+	const epsilon = 1e-6
+	// max is the maxmium number of iterations of the search
+	const max = 100
+
+	lles, err := geo.DecodeZPolyline(s.Map)
+	if err != nil {
+		return 0, err
+	}
+	lls := geo.LatLngs(lles)
+
+	// The power required to complete the segment falls off far faster with time
+	// than the power the rider is able to hold, so there is a single crossing.
+	tl, tm, th := 1.0, 3600.0, 6*3600.0
+	if requiredPower(th, lls, s, c, r) > pd(th) {
+		return 0, fmt.Errorf("%s would take longer than %.0fs", s.Name, th)
+	}
+	for j := 0; j < max; j++ {
+		req := requiredPower(tm, lls, s, c, r)
+		p := pd(tm)
+		if calc.Eqf(req, p, epsilon) {
+			return tm, nil
+		}
+
+		if req > p {
+			tl = tm
+		} else {
+			th = tm
+		}
+
+		tm = (th + tl) / 2.0
+	}
+
+	return 0, fmt.Errorf("predicting the time for %s did not converge after %d iterations", s.Name, max)
+}
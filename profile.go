@@ -0,0 +1,48 @@
+package stravutils
+
+import (
+	"fmt"
+
+	"github.com/scheibo/geo"
+)
+
+// ProfilePoint is a point along a segment's elevation profile.
+type ProfilePoint struct {
+	// Distance in meters from the start of the segment.
+	Distance  float64 `json:"distance"`
+	Elevation float64 `json:"elevation"`
+	// Grade of the section of the segment ending at this point.
+	Grade  float64    `json:"grade"`
+	LatLng geo.LatLng `json:"latlng"`
+}
+
+// Profile returns the elevation profile of the segment from its map.
+func Profile(s *Segment) ([]ProfilePoint, error) {
+	if s.Map == "" {
+		return nil, fmt.Errorf("segment %d has no map", s.ID)
+	}
+	lles, err := geo.DecodeZPolyline(s.Map)
+	if err != nil {
+		return nil, err
+	}
+	return profile(lles), nil
+}
+
+func profile(lles []geo.LatLngEle) []ProfilePoint {
+	points := make([]ProfilePoint, len(lles))
+	d := 0.0
+	for i, lle := range lles {
+		p := ProfilePoint{Elevation: lle.Ele, LatLng: lle.LatLng()}
+		if i > 0 {
+			prev := lles[i-1]
+			dd := geo.Distance(prev.LatLng(), p.LatLng)
+			d += dd
+			if dd > 0 {
+				p.Grade = (lle.Ele - prev.Ele) / dd
+			}
+		}
+		p.Distance = d
+		points[i] = p
+	}
+	return points
+}
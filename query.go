@@ -0,0 +1,429 @@
+package stravutils
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/scheibo/geo"
+)
+
+// DEFAULT_WITHIN is the radius in meters used for 'near' queries which don't
+// specify one.
+const DEFAULT_WITHIN = 10000.0
+
+var COMPASS = [...]string{
+	"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE",
+	"S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW",
+}
+
+// COMPASS_SECTOR is the width in degrees of the range of bearings each of the
+// COMPASS directions covers.
+const COMPASS_SECTOR = 360.0 / float64(len(COMPASS))
+
+// FIELD_ALIASES are shorter names for Segment fields which may be used in
+// queries.
+var FIELD_ALIASES = map[string]string{
+	"grade":     "average_grade",
+	"gain":      "total_elevation_gain",
+	"climb":     "total_elevation_gain",
+	"elevation": "median_elevation",
+	"low":       "elevation_low",
+	"high":      "elevation_high",
+	"length":    "distance",
+	"direction": "average_direction",
+	"bearing":   "average_direction",
+}
+
+var operator = regexp.MustCompile(`\s*(<=|>=|!=|=|<|>|~)\s*`)
+var comparison = regexp.MustCompile(`^([a-zA-Z_]+)(<=|>=|!=|=|<|>|~)(.+)$`)
+var quantity = regexp.MustCompile(`^(-?[0-9.]+)(%|km|m)?$`)
+
+// Catalog is a collection of climbs which can be queried.
+type Catalog []Climb
+
+// Filter restricts results to climbs whose segment's Field compares to Value
+// (or Text for string fields) according to Op.
+type Filter struct {
+	Field string
+	Op    string
+	Value float64
+	Text  string
+}
+
+// Query is a parsed catalog query, eg.
+//
+//	near 37.40,-122.25 within 10km grade>7% distance<5km direction=N sort gain desc limit 5
+//
+// Bare words match the names and aliases of climbs.
+type Query struct {
+	Near   *geo.LatLng
+	Within float64
+	Terms  []string
+	Filter []Filter
+	Sort   string
+	Desc   bool
+	Limit  int
+}
+
+// Match is a climb which satisfies a query, along with its distance in
+// meters from the query's 'near' point, if any.
+type Match struct {
+	Climb    Climb   `json:"climb"`
+	Distance float64 `json:"distance,omitempty"`
+}
+
+// ParseQuery parses a query string.
+func ParseQuery(s string) (*Query, error) {
+	q := &Query{}
+	tokens := tokenize(operator.ReplaceAllString(s, "$1"))
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		next := func() (string, error) {
+			if i+1 >= len(tokens) {
+				return "", fmt.Errorf("expected a value after '%s'", tok)
+			}
+			i++
+			return tokens[i], nil
+		}
+
+		switch strings.ToLower(tok) {
+		case "and":
+			continue
+		case "near":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			ll, err := parseLatLng(v)
+			if err != nil {
+				return nil, err
+			}
+			q.Near = &ll
+		case "within":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			d, unit, err := parseQuantity(v)
+			if err != nil {
+				return nil, err
+			}
+			if unit == "%" {
+				return nil, fmt.Errorf("invalid distance: %s", v)
+			}
+			q.Within = d
+		case "sort":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(v, "-") {
+				q.Desc = true
+				v = v[1:]
+			}
+			f, err := queryField(v)
+			if err != nil {
+				return nil, err
+			}
+			q.Sort = f
+			if i+1 < len(tokens) {
+				switch strings.ToLower(tokens[i+1]) {
+				case "desc":
+					q.Desc = true
+					i++
+				case "asc":
+					q.Desc = false
+					i++
+				}
+			}
+		case "limit":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid limit: %s", v)
+			}
+			q.Limit = n
+		default:
+			m := comparison.FindStringSubmatch(tok)
+			if m == nil {
+				q.Terms = append(q.Terms, simplify(tok, true))
+				continue
+			}
+			f, err := parseFilter(m[1], m[2], m[3])
+			if err != nil {
+				return nil, err
+			}
+			q.Filter = append(q.Filter, f)
+		}
+	}
+
+	if q.Within > 0 && q.Near == nil {
+		return nil, fmt.Errorf("'within' requires 'near'")
+	}
+	if q.Near != nil && q.Within == 0 {
+		q.Within = DEFAULT_WITHIN
+	}
+	return q, nil
+}
+
+// tokenize splits s on whitespace except within double quotes, which are
+// removed.
+func tokenize(s string) []string {
+	var tokens []string
+	var tok strings.Builder
+	quoted, empty := false, true
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted, empty = !quoted, false
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if !empty {
+				tokens = append(tokens, tok.String())
+				tok.Reset()
+				empty = true
+			}
+		default:
+			tok.WriteRune(r)
+			empty = false
+		}
+	}
+	if !empty {
+		tokens = append(tokens, tok.String())
+	}
+	return tokens
+}
+
+func parseLatLng(s string) (ll geo.LatLng, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid location: %s", s)
+		}
+	}()
+	return geo.ParseLatLng(s)
+}
+
+func parseQuantity(s string) (float64, string, error) {
+	m := quantity.FindStringSubmatch(strings.ToLower(s))
+	if m == nil {
+		return 0, "", fmt.Errorf("invalid quantity: %s", s)
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, "", err
+	}
+	switch m[2] {
+	case "%":
+		v /= 100
+	case "km":
+		v *= 1000
+	}
+	return v, m[2], nil
+}
+
+func parseFilter(name, op, value string) (Filter, error) {
+	f, err := queryField(name)
+	if err != nil {
+		return Filter{}, err
+	}
+	filter := Filter{Field: f, Op: op}
+
+	if f == "name" || op == "~" {
+		if op != "=" && op != "!=" && op != "~" {
+			return Filter{}, fmt.Errorf("invalid operator for %s: %s", name, op)
+		}
+		filter.Text = value
+		return filter, nil
+	}
+
+	if f == "average_direction" {
+		if op != "=" && op != "!=" {
+			return Filter{}, fmt.Errorf("invalid operator for %s: %s", name, op)
+		}
+		for i, c := range COMPASS {
+			if strings.EqualFold(c, value) {
+				filter.Value = float64(i) * COMPASS_SECTOR
+				filter.Text = c
+				return filter, nil
+			}
+		}
+	}
+
+	v, _, err := parseQuantity(value)
+	if err != nil {
+		return Filter{}, err
+	}
+	filter.Value = v
+	return filter, nil
+}
+
+// queryField resolves the name of a Segment field in a query to its snake case
+// name, eg. 'AverageGrade', 'average_grade' and 'grade' are equivalent.
+func queryField(name string) (string, error) {
+	n := strings.ToLower(name)
+	if a, ok := FIELD_ALIASES[n]; ok {
+		n = a
+	}
+	for f := range SEGMENT_FIELDS {
+		if n == f || n == strings.Replace(f, "_", "", -1) {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("unknown field: %s", name)
+}
+
+// SEGMENT_FIELDS are accessors for each of the fields of a Segment by their
+// snake case name.
+var SEGMENT_FIELDS = map[string]func(s *Segment) interface{}{
+	"name":                 func(s *Segment) interface{} { return s.Name },
+	"id":                   func(s *Segment) interface{} { return s.ID },
+	"distance":             func(s *Segment) interface{} { return s.Distance },
+	"average_grade":        func(s *Segment) interface{} { return s.AverageGrade },
+	"elevation_low":        func(s *Segment) interface{} { return s.ElevationLow },
+	"elevation_high":       func(s *Segment) interface{} { return s.ElevationHigh },
+	"total_elevation_gain": func(s *Segment) interface{} { return s.TotalElevationGain },
+	"median_elevation":     func(s *Segment) interface{} { return s.MedianElevation },
+	"start_location":       func(s *Segment) interface{} { return s.StartLocation },
+	"end_location":         func(s *Segment) interface{} { return s.EndLocation },
+	"average_location":     func(s *Segment) interface{} { return s.AverageLocation },
+	"average_direction":    func(s *Segment) interface{} { return s.AverageDirection },
+	"map":                  func(s *Segment) interface{} { return s.Map },
+}
+
+// fieldValue returns the value of the named field of the segment.
+func fieldValue(s *Segment, f string) interface{} {
+	if v, ok := SEGMENT_FIELDS[f]; ok {
+		return v(s)
+	}
+	return nil
+}
+
+func (f *Filter) matches(c *Climb) bool {
+	s := &c.Segment
+	if f.Op == "~" {
+		t := simplify(f.Text, true)
+		if strings.Contains(simplify(fmt.Sprint(fieldValue(s, f.Field)), true), t) {
+			return true
+		}
+		if f.Field == "name" {
+			return matchesName(c, t)
+		}
+		return false
+	}
+
+	switch v := fieldValue(s, f.Field).(type) {
+	case string:
+		eq := strings.EqualFold(v, f.Text) || (f.Field == "name" && strings.EqualFold(c.Name, f.Text))
+		return eq == (f.Op == "=")
+	case int64:
+		return compareValues(float64(v), f.Op, f.Value)
+	case float64:
+		if f.Field == "average_direction" {
+			// Directions match the sector of bearings closest to them, eg. 'N' is
+			// 348.75° - 11.25°, so that neighbouring directions don't overlap.
+			d := math.Mod(v-f.Value+COMPASS_SECTOR/2+720, 360)
+			return (d < COMPASS_SECTOR) == (f.Op == "=")
+		}
+		return compareValues(v, f.Op, f.Value)
+	default:
+		return false
+	}
+}
+
+func compareValues(a float64, op string, b float64) bool {
+	switch op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	}
+	return false
+}
+
+func matchesName(c *Climb, term string) bool {
+	names := append([]string{c.Name, c.Segment.Name}, c.Aliases...)
+	for _, n := range names {
+		if strings.Contains(simplify(n, true), term) {
+			return true
+		}
+	}
+	return false
+}
+
+// Query returns the climbs in the catalog which satisfy the query.
+func (cat Catalog) Query(q *Query) []Match {
+	var matches []Match
+
+outer:
+	for _, c := range cat {
+		c := c
+		m := Match{Climb: c}
+
+		if q.Near != nil {
+			m.Distance = geo.Distance(*q.Near, c.Segment.StartLocation)
+			if m.Distance > q.Within {
+				continue
+			}
+		}
+		for _, t := range q.Terms {
+			if !matchesName(&c, t) {
+				continue outer
+			}
+		}
+		for _, f := range q.Filter {
+			if !f.matches(&c) {
+				continue outer
+			}
+		}
+
+		matches = append(matches, m)
+	}
+
+	if q.Sort != "" {
+		sort.SliceStable(matches, func(i, j int) bool {
+			a, b := &matches[i].Climb.Segment, &matches[j].Climb.Segment
+			if q.Desc {
+				a, b = b, a
+			}
+			return lessValue(fieldValue(a, q.Sort), fieldValue(b, q.Sort))
+		})
+	} else if q.Near != nil {
+		sort.SliceStable(matches, func(i, j int) bool {
+			return matches[i].Distance < matches[j].Distance
+		})
+	}
+
+	if q.Limit > 0 && len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+	}
+	return matches
+}
+
+func lessValue(a, b interface{}) bool {
+	switch x := a.(type) {
+	case string:
+		return x < b.(string)
+	case int64:
+		return x < b.(int64)
+	case float64:
+		return x < b.(float64)
+	case geo.LatLng:
+		y := b.(geo.LatLng)
+		return x.Lat < y.Lat || (x.Lat == y.Lat && x.Lng < y.Lng)
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package stravutils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+
+	"github.com/scheibo/calc"
+	"github.com/scheibo/geo"
+	"github.com/scheibo/perf"
+	"github.com/scheibo/weather"
+	"github.com/scheibo/wnf"
+)
+
+// The rider masses the PERF world record curves are normalized against.
+const MR_M = wnf.Mr
+const MR_F = 53.0
+
+type Rider struct {
+	// Sex of the rider, "M" or "F".
+	Sex string `json:"sex,omitempty"`
+	// Mass of the rider in kg.
+	Mass float64 `json:"mass"`
+	// Mass of the bicycle in kg.
+	BikeMass float64 `json:"bike_mass,omitempty"`
+	// Coefficient of drag area, defaults depend on the segment being ridden.
+	CdA float64 `json:"cda,omitempty"`
+	// The PERF score the rider is typically capable of.
+	PERF float64 `json:"perf,omitempty"`
+	// How the rider's FTP should be estimated, defaults are used if omitted.
+	FTP *FTPConfig `json:"ftp,omitempty"`
+}
+
+// FTPConfig configures how climbing FTP translates to FTP on flat roads and
+// in a TT position, and how the three should be mixed.
+type FTPConfig struct {
+	ClimbToFlat float64    `json:"climb_to_flat,omitempty"`
+	RoadToTT    float64    `json:"road_to_tt,omitempty"`
+	Mix         [3]float64 `json:"mix,omitempty"`
+}
+
+func GetRider(files ...string) (*Rider, error) {
+	rider := Rider{Sex: "M", Mass: wnf.Mr, BikeMass: wnf.Mb}
+
+	file := Resource("rider")
+	if len(files) > 0 && files[0] != "" {
+		file = Resource(files[0])
+	}
+
+	f, err := ioutil.ReadFile(file)
+	if err != nil {
+		return &rider, err
+	}
+
+	err = json.Unmarshal(f, &rider)
+	if err != nil {
+		return &rider, err
+	}
+
+	return &rider, nil
+}
+
+func (r *Rider) TotalMass() float64 {
+	mb := r.BikeMass
+	if mb <= 0 {
+		mb = wnf.Mb
+	}
+	return r.Mass + mb
+}
+
+func (r *Rider) Cda(s *Segment) float64 {
+	if r.CdA > 0 {
+		return r.CdA
+	}
+	if s.AverageGrade < CLIMB_THRESHOLD {
+		return wnf.CdaTT
+	}
+	return wnf.CdaClimb
+}
+
+// Cp returns the 'world record' power for a rider of the same sex as r for a
+// performance of duration t.
+func (r *Rider) Cp(t float64) float64 {
+	if r.Sex == "F" {
+		return perf.CpF(t)
+	}
+	return perf.CpM(t)
+}
+
+func (r *Rider) referenceMass() float64 {
+	if r.Sex == "F" {
+		return MR_F
+	}
+	return MR_M
+}
+
+// StillAirPower returns the power required for r to complete s in t seconds
+// without any wind.
+func (r *Rider) StillAirPower(t float64, s *Segment) float64 {
+	vg := s.Distance / t
+	return calc.Psimp(
+		calc.Rho(s.MedianElevation, calc.G),
+		r.Cda(s), calc.Crr, vg, vg, s.AverageGrade, r.TotalMass(), calc.G, calc.Ec, calc.Fw)
+}
+
+// Score returns the PERF score for r holding power p for t seconds on s. The
+// power is scaled to the reference mass of the PERF curves so that scores are
+// comparable between riders.
+func (r *Rider) Score(p, t float64, s *Segment) float64 {
+	p = p / r.Mass * r.referenceMass()
+	return perf.Score(p, calc.AltitudeAdjust(r.Cp(t), s.MedianElevation))
+}
+
+// PERFPower is the inverse of Score, returning the power r would hold for t
+// seconds on s for a performance with PERF score score.
+func (r *Rider) PERFPower(score, t float64, s *Segment) float64 {
+	wr := calc.AltitudeAdjust(r.Cp(t), s.MedianElevation)
+	p := wr * math.Pow(score/1000, 1/1.8)
+	return p / r.referenceMass() * r.Mass
+}
+
+// RequiredPower returns the average power r must hold to complete s in exactly
+// t seconds under conditions c (or in still air if c is nil).
+func RequiredPower(t float64, s *Segment, c *weather.Conditions, r *Rider) (float64, error) {
+	lles, err := geo.DecodeZPolyline(s.Map)
+	if err != nil {
+		return 0, err
+	}
+	return requiredPower(t, geo.LatLngs(lles), s, c, r), nil
+}
+
+func requiredPower(t float64, lls []geo.LatLng, s *Segment, c *weather.Conditions, r *Rider) float64 {
+	p := r.StillAirPower(t, s)
+	if c == nil {
+		return p
+	}
+
+	// wnf.PowerLL determines the time p takes in still air (ie. t) and returns the
+	// ratio of the power required to match that time under the conditions.
+	return p * wnf.PowerLL(
+		p,
+		lls,
+		s.Distance,
+		s.MedianElevation,
+		c.AirDensity,
+		r.Cda(s),
+		c.WindSpeed,
+		c.WindBearing,
+		s.AverageGrade,
+		r.TotalMass())
+}
@@ -0,0 +1,189 @@
+package stravutils
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/antzucaro/matchr"
+	"github.com/scheibo/fuzzy"
+)
+
+// DECISIVE_MARGIN is how much better than the runner up the best search result
+// must score to be chosen without asking.
+const DECISIVE_MARGIN = 0.1
+
+// PREFIX_SCORE is the score of a query token which is a prefix of a name's
+// token, scaled up to 1 by how much of the name's token it covers.
+const PREFIX_SCORE = 0.85
+
+// PHONETIC_SCORE is the score of a query token which sounds like a name's
+// token.
+const PHONETIC_SCORE = 0.8
+
+var nonalphanum = regexp.MustCompile("[^a-z0-9]+")
+
+// SearchIndex ranks climbs by how well their names, segment names and aliases
+// match a query.
+type SearchIndex struct {
+	climbs  []Climb
+	entries []indexEntry
+}
+
+type indexEntry struct {
+	climb  int
+	name   string
+	simple string
+	tokens []indexToken
+}
+
+type indexToken struct {
+	text      string
+	primary   string
+	secondary string
+}
+
+// SearchResult is a climb matching a search along with the name it matched by
+// and a score between 0 and 1.
+type SearchResult struct {
+	Climb Climb   `json:"climb"`
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+}
+
+// AmbiguousError is returned when a search has no decisive result.
+type AmbiguousError struct {
+	Query      string
+	Candidates []SearchResult
+}
+
+func (e *AmbiguousError) Error() string {
+	if len(e.Candidates) == 0 {
+		return fmt.Sprintf("could not find a segment matching: %s", e.Query)
+	}
+	var cs []string
+	for _, c := range e.Candidates {
+		cs = append(cs, fmt.Sprintf("  %s (%d) = %.2f", c.Name, c.Climb.Segment.ID, c.Score))
+	}
+	return fmt.Sprintf("ambiguous segment '%s', did you mean:\n%s", e.Query, strings.Join(cs, "\n"))
+}
+
+// NewSearchIndex builds a SearchIndex over the climbs.
+func NewSearchIndex(climbs []Climb) *SearchIndex {
+	idx := &SearchIndex{climbs: climbs}
+	for i, c := range climbs {
+		names := append([]string{c.Name, c.Segment.Name}, c.Aliases...)
+		for _, n := range names {
+			if n == "" {
+				continue
+			}
+			e := indexEntry{climb: i, name: n, simple: simplify(n, true)}
+			for _, t := range tokenizeName(n) {
+				p, s := matchr.DoubleMetaphone(t)
+				e.tokens = append(e.tokens, indexToken{t, p, s})
+			}
+			idx.entries = append(idx.entries, e)
+		}
+	}
+	return idx
+}
+
+func tokenizeName(s string) []string {
+	return strings.Fields(nonalphanum.ReplaceAllString(strings.ToLower(s), " "))
+}
+
+// Search returns up to n of the climbs which best match the query in order of
+// decreasing score. If n <= 0 all climbs are returned.
+func (idx *SearchIndex) Search(query string, n int) []SearchResult {
+	simple := simplify(query, true)
+	var tokens []indexToken
+	for _, t := range tokenizeName(query) {
+		p, s := matchr.DoubleMetaphone(t)
+		tokens = append(tokens, indexToken{t, p, s})
+	}
+
+	best := make(map[int]SearchResult)
+	for _, e := range idx.entries {
+		score := e.score(simple, tokens)
+		if r, ok := best[e.climb]; !ok || score > r.Score {
+			best[e.climb] = SearchResult{Climb: idx.climbs[e.climb], Name: e.name, Score: score}
+		}
+	}
+
+	var results []SearchResult
+	for _, r := range best {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score == results[j].Score {
+			return results[i].Name < results[j].Name
+		}
+		return results[i].Score > results[j].Score
+	})
+
+	if n > 0 && len(results) > n {
+		results = results[:n]
+	}
+	return results
+}
+
+func (e *indexEntry) score(simple string, tokens []indexToken) float64 {
+	if simple == e.simple {
+		return 1
+	}
+	_, whole := fuzzy.Match(simple, []string{e.simple})
+	if len(tokens) == 0 || len(e.tokens) == 0 {
+		return whole
+	}
+
+	// Each of the query's tokens is scored against the best matching token of
+	// the name, penalizing names with many more tokens than the query.
+	total := 0.0
+	for _, q := range tokens {
+		max := 0.0
+		for _, t := range e.tokens {
+			if s := q.score(&t); s > max {
+				max = s
+			}
+		}
+		total += max
+	}
+	partial := total / float64(len(tokens))
+	if len(e.tokens) > len(tokens) {
+		partial *= 1 - 0.05*float64(len(e.tokens)-len(tokens))
+	}
+
+	if partial > whole {
+		return partial
+	}
+	return whole
+}
+
+func (q *indexToken) score(t *indexToken) float64 {
+	if q.text == t.text {
+		return 1
+	}
+	if len(q.text) >= 2 && strings.HasPrefix(t.text, q.text) {
+		return PREFIX_SCORE + (1-PREFIX_SCORE)*float64(len(q.text))/float64(len(t.text))
+	}
+
+	s := matchr.JaroWinkler(q.text, t.text, false)
+	if q.primary != "" && (q.primary == t.primary || q.primary == t.secondary ||
+		(q.secondary != "" && (q.secondary == t.primary || q.secondary == t.secondary))) {
+		if s < PHONETIC_SCORE {
+			s = PHONETIC_SCORE
+		}
+	}
+	return s
+}
+
+// Decisive returns whether the best of the results is good enough and far
+// enough ahead of the rest to be chosen automatically.
+func Decisive(results []SearchResult) bool {
+	if len(results) == 0 || results[0].Score < MATCH_THRESHOLD {
+		return false
+	}
+	return len(results) == 1 || results[0].Score-results[1].Score >= DECISIVE_MARGIN ||
+		(results[0].Score == 1 && results[1].Score < 1)
+}
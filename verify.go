@@ -0,0 +1,270 @@
+package stravutils
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/scheibo/weather"
+)
+
+// ARCHIVE_VERSION is the version of the ForecastArchive schema.
+const ARCHIVE_VERSION = 1
+
+// ARCHIVE_EXT is the extension of the gzipped JSON archive files.
+const ARCHIVE_EXT = ".json.gz"
+
+// ARCHIVE_TIME_FORMAT names each archive by the time it was generated in UTC.
+const ARCHIVE_TIME_FORMAT = "20060102T150405Z"
+
+// ForecastArchive is the hourly forecasts for segments made at a time.
+type ForecastArchive struct {
+	Version   int                 `json:"version"`
+	Generated time.Time           `json:"generated"`
+	Forecasts []*ArchivedForecast `json:"forecasts"`
+}
+
+// ArchivedForecast is a segment's hourly forecast. The segment's map is
+// omitted to keep archives small.
+type ArchivedForecast struct {
+	Segment *Segment              `json:"segment"`
+	Hourly  []*weather.Conditions `json:"hourly"`
+}
+
+// NewArchivedForecast archives the hourly forecast for s.
+func NewArchivedForecast(s *Segment, f *weather.Forecast) *ArchivedForecast {
+	segment := *s
+	segment.Map = ""
+	return &ArchivedForecast{Segment: &segment, Hourly: f.Hourly}
+}
+
+// WriteForecastArchive writes the archive into dir, named by the time it was
+// generated.
+func WriteForecastArchive(dir string, a *ForecastArchive) error {
+	path := filepath.Join(dir, a.Generated.UTC().Format(ARCHIVE_TIME_FORMAT)+ARCHIVE_EXT)
+	file, err := create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(file)
+	err = json.NewEncoder(gz).Encode(a)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ReadForecastArchive reads the archive at path.
+func ReadForecastArchive(path string) (*ForecastArchive, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	defer gz.Close()
+
+	var a ForecastArchive
+	err = json.NewDecoder(gz).Decode(&a)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if a.Version > ARCHIVE_VERSION {
+		return nil, fmt.Errorf("%s: unsupported archive version %d", path, a.Version)
+	}
+	return &a, nil
+}
+
+// ReadForecastArchives reads every archive in dir generated between since and
+// until, oldest first. Either bound is ignored if zero.
+func ReadForecastArchives(dir string, since, until time.Time) ([]*ForecastArchive, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var archives []*ForecastArchive
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, ARCHIVE_EXT) {
+			continue
+		}
+		// Archives outside of the range can be skipped without reading them if
+		// they're named by the time they were generated.
+		if t, err := time.Parse(ARCHIVE_TIME_FORMAT, strings.TrimSuffix(name, ARCHIVE_EXT)); err == nil &&
+			((!since.IsZero() && t.Before(since)) || (!until.IsZero() && t.After(until))) {
+			continue
+		}
+		a, err := ReadForecastArchive(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if (!since.IsZero() && a.Generated.Before(since)) || (!until.IsZero() && a.Generated.After(until)) {
+			continue
+		}
+		archives = append(archives, a)
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].Generated.Before(archives[j].Generated)
+	})
+	return archives, nil
+}
+
+// VerificationSample pairs the conditions forecasted for a segment at a time
+// with those which were observed.
+type VerificationSample struct {
+	Segment  *Segment
+	Time     time.Time
+	Lead     time.Duration
+	Forecast *weather.Conditions
+	Observed *weather.Conditions
+	// The baseline WNF under the forecasted and observed conditions.
+	ForecastWNF float64
+	ObservedWNF float64
+}
+
+// Verify pairs each hour forecasted in the archives which is before now with
+// the conditions observed for it. Hours forecasted with a lead time longer
+// than maxLead are skipped if maxLead is positive. Hours whose conditions
+// weren't observed or are missing from the cache when offline are skipped and
+// counted in unobserved.
+func (w *Weather) Verify(archives []*ForecastArchive, now time.Time, maxLead time.Duration) ([]*VerificationSample, int, error) {
+	var samples []*VerificationSample
+	unobserved := 0
+	for _, a := range archives {
+		for _, af := range a.Forecasts {
+			for _, c := range af.Hourly {
+				lead := c.Time.Sub(a.Generated)
+				if lead < 0 || !c.Time.Before(now) || (maxLead > 0 && lead > maxLead) {
+					continue
+				}
+
+				observed, err := w.HistoricalConditions(af.Segment.AverageLocation, c.Time)
+				if _, miss := err.(*CacheMissError); miss || (err == nil && observed == nil) {
+					unobserved++
+					continue
+				}
+				if err != nil {
+					return nil, unobserved, err
+				}
+				fwnf, _, err := WNF(af.Segment, c, nil)
+				if err != nil {
+					return nil, unobserved, err
+				}
+				ownf, _, err := WNF(af.Segment, observed, nil)
+				if err != nil {
+					return nil, unobserved, err
+				}
+
+				samples = append(samples, &VerificationSample{
+					Segment:     af.Segment,
+					Time:        c.Time,
+					Lead:        lead,
+					Forecast:    c,
+					Observed:    observed,
+					ForecastWNF: fwnf,
+					ObservedWNF: ownf,
+				})
+			}
+		}
+	}
+	return samples, unobserved, nil
+}
+
+// ErrorStats summarize the errors of forecasts against observations. Bias is
+// the mean of forecast - observed, and MAE and RMSE are the mean absolute and
+// root mean squared errors. Wind speeds are in m/s, bearings in degrees, air
+// densities in kg/m³ and WNFs in percentage points.
+type ErrorStats struct {
+	N int `json:"n"`
+
+	WindSpeedBias float64 `json:"wind_speed_bias"`
+	WindSpeedMAE  float64 `json:"wind_speed_mae"`
+	WindSpeedRMSE float64 `json:"wind_speed_rmse"`
+
+	// Bearings are only compared when the observed wind is at least the
+	// minimum speed given to NewErrorStats, as they're meaningless in calm.
+	BearingN   int     `json:"bearing_n"`
+	BearingMAE float64 `json:"bearing_mae"`
+
+	AirDensityBias float64 `json:"air_density_bias"`
+	AirDensityMAE  float64 `json:"air_density_mae"`
+
+	WNFBias float64 `json:"wnf_bias"`
+	WNFMAE  float64 `json:"wnf_mae"`
+	WNFRMSE float64 `json:"wnf_rmse"`
+}
+
+// NewErrorStats computes the ErrorStats of samples, comparing bearings only
+// when the observed wind speed is at least minSpeed.
+func NewErrorStats(samples []*VerificationSample, minSpeed float64) ErrorStats {
+	var st ErrorStats
+	for _, s := range samples {
+		st.N++
+
+		d := s.Forecast.WindSpeed - s.Observed.WindSpeed
+		st.WindSpeedBias += d
+		st.WindSpeedMAE += math.Abs(d)
+		st.WindSpeedRMSE += d * d
+
+		if s.Observed.WindSpeed >= minSpeed {
+			st.BearingN++
+			st.BearingMAE += bearingDifference(s.Forecast.WindBearing, s.Observed.WindBearing)
+		}
+
+		d = s.Forecast.AirDensity - s.Observed.AirDensity
+		st.AirDensityBias += d
+		st.AirDensityMAE += math.Abs(d)
+
+		d = (s.ForecastWNF - s.ObservedWNF) * 100
+		st.WNFBias += d
+		st.WNFMAE += math.Abs(d)
+		st.WNFRMSE += d * d
+	}
+
+	if st.N > 0 {
+		n := float64(st.N)
+		st.WindSpeedBias /= n
+		st.WindSpeedMAE /= n
+		st.WindSpeedRMSE = math.Sqrt(st.WindSpeedRMSE / n)
+		st.AirDensityBias /= n
+		st.AirDensityMAE /= n
+		st.WNFBias /= n
+		st.WNFMAE /= n
+		st.WNFRMSE = math.Sqrt(st.WNFRMSE / n)
+	}
+	if st.BearingN > 0 {
+		st.BearingMAE /= float64(st.BearingN)
+	}
+	return st
+}
+
+// bearingDifference returns the absolute difference in degrees [0-180]
+// between the bearings a and b.
+func bearingDifference(a, b float64) float64 {
+	d := math.Mod(math.Abs(a-b), 360)
+	if d > 180 {
+		d = 360 - d
+	}
+	return d
+}